@@ -19,10 +19,12 @@ package config
 import (
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/ctdk/spqr/internal/groups"
 	"github.com/jessevdk/go-flags"
 	"github.com/tideland/golib/logger"
 	"log"
 	"os"
+	"regexp"
 	"runtime"
 	"strings"
 )
@@ -30,6 +32,10 @@ import (
 const Version = "0.1.0"
 
 const defaultUserKeyPrefix = "org/default/users"
+const defaultGroupKeyPrefix = "org/default/groups"
+const defaultHomeArchiveDir = "/var/lib/spqr/archive"
+const defaultOverrideKey = "org/default/spqr/override-blast-radius"
+const defaultSpqrKeyPrefix = "org/default/spqr"
 
 var debugLevelDesc = map[int]string{0: "debug", 1: "info", 2: "warning", 3: "error", 4: "critical", 5: "fatal"}
 
@@ -40,13 +46,44 @@ var LogLevelNames = map[string]int{"debug": 5, "info": 4, "warning": 3, "error":
 var GitHash = "unknown"
 
 type Conf struct {
-	ConsulHttpAddr string `toml:"consul-http-addr"`
-	UserKeyPrefix  string `toml:"user-key-prefix"`
-	DebugLevel     int
-	LogLevel       string `toml:"log-level"`
-	LogFile        string `toml:log-file"`
-	SysLog         bool   `toml:"syslog"`
-	StateFile      string `toml:"state-file"`
+	ConsulHttpAddr     string `toml:"consul-http-addr"`
+	UserKeyPrefix      string `toml:"user-key-prefix"`
+	DebugLevel         int
+	LogLevel           string                `toml:"log-level"`
+	LogFile            string                `toml:"log-file"`
+	SysLog             bool                  `toml:"syslog"`
+	StateFile          string                `toml:"state-file"`
+	MergePolicy        string                `toml:"membership-merge-policy"`
+	Daemon             bool                  `toml:"daemon"`
+	GroupKeyPrefix     string                `toml:"group-key-prefix"`
+	DisablePolicy      *groups.DisablePolicy `toml:"disable-policy"`
+	UserStateFile      string                `toml:"user-state-file"`
+	HomeArchiveDir     string                `toml:"home-archive-dir"`
+	ProtectedUsers     []string              `toml:"protected-users"`
+	ProtectedProcesses []string              `toml:"protected-process-patterns"`
+	MaxDisableCount    int                   `toml:"max-disable-count"`
+	MaxDisablePercent  float64               `toml:"max-disable-percent"`
+	OverrideKey        string                `toml:"blast-radius-override-key"`
+	OverrideLimit      bool                  `toml:"override-blast-radius"`
+	InactiveDays       int                   `toml:"disable-after-inactive-days"`
+	AccountBackend     string                `toml:"account-backend"`
+	Root               string                `toml:"root"`
+	CommandTimeout     int                   `toml:"command-timeout"`
+	AuditLog           string                `toml:"audit-log"`
+	VerifyAuditLog     string                `toml:"-"`
+	SpqrKeyPrefix      string                `toml:"spqr-key-prefix"`
+	PublishStatus      bool                  `toml:"publish-status"`
+	PublishInventory   bool                  `toml:"publish-inventory"`
+	NodeName           string                `toml:"node-name"`
+	Report             *ReportQuery          `toml:"-"`
+}
+
+// ReportQuery is what the report command was asked to report on.
+type ReportQuery struct {
+	// Kind is "user", "group", or "drift".
+	Kind   string
+	Name   string
+	Format string
 }
 
 type Options struct {
@@ -59,6 +96,30 @@ type Options struct {
 	LogLevel       string `short:"g" long:"log-level" description:"Specify logging verbosity.  Performs the same function as -V, but works like the 'log-level' option in the configuration file. Acceptable values are 'debug', 'info', 'warning', 'error', 'critical', and 'fatal'." env:"SPQR_LOG_LEVEL"`
 	StateFile      string `short:"s" long:"statefile" description:"Store spqr's state in this file."`
 	Verbose        []bool `short:"V" long:"verbose" description:"Show verbose debug information. Repeat for more verbosity."`
+	UserStateFile  string `short:"u" long:"user-state-file" description:"Store per-user state, like when users were disabled, in this file. Defaults to the state file's path with '.users' added to the end, if there is a state file."`
+	HomeArchiveDir string `short:"A" long:"home-archive-dir" description:"Archive home directories of deleted users to this directory. Default value: '/var/lib/spqr/archive'."`
+	Daemon         bool   `short:"D" long:"daemon" description:"Run as a daemon that watches the group key prefix in consul itself, rather than being run by a consul watch." env:"SPQR_DAEMON"`
+	GroupKeyPrefix string `short:"G" long:"group-key-prefix" description:"Consul key prefix for the groups to watch when running as a daemon. Default value: 'org/default/groups'." env:"SPQR_GROUP_KEY_PREFIX"`
+	OverrideLimit  bool   `short:"O" long:"override-blast-radius" description:"Go ahead with a run even if it would disable or delete more users than the configured limits allow."`
+	AccountBackend string `short:"B" long:"account-backend" description:"How to manage accounts on this machine. Default value: 'shadow-utils', or 'busybox' if shadow-utils isn't installed." env:"SPQR_ACCOUNT_BACKEND"`
+	Root           string `short:"R" long:"root" description:"Manage the users in the filesystem tree under this directory, like a chroot or a mounted disk image, rather than on the running system." env:"SPQR_ROOT"`
+	AuditLog       string `short:"a" long:"audit-log" description:"Append a JSON record of every change made to users to this file." env:"SPQR_AUDIT_LOG"`
+	VerifyAuditLog string `long:"verify-audit-log" description:"Check that the audit log at this path hasn't been tampered with, and exit."`
+	SpqrKeyPrefix  string `short:"k" long:"spqr-key-prefix" description:"Consul key prefix for what spqr publishes about the nodes it runs on. Default value: 'org/default/spqr'." env:"SPQR_KEY_PREFIX"`
+	PublishStatus  bool   `long:"publish-status" description:"After each run, publish how it went to the node's status key under the spqr key prefix." env:"SPQR_PUBLISH_STATUS"`
+	Inventory      bool   `long:"publish-inventory" description:"After each run, publish what the accounts spqr manages actually look like to the node's inventory key under the spqr key prefix." env:"SPQR_PUBLISH_INVENTORY"`
+	NodeName       string `short:"N" long:"node-name" description:"Publish this node's status and inventory under this name. Defaults to the consul agent's node name." env:"SPQR_NODE_NAME"`
+	MergePolicy    string `short:"m" long:"membership-merge-policy" description:"How to settle a user's status when they're in more than one group with different statuses. Acceptable values are 'enabled-wins' (the default) and 'disabled-wins'." env:"SPQR_MEMBERSHIP_MERGE_POLICY"`
+}
+
+type reportOptions struct {
+	Format string `short:"f" long:"format" choice:"table" choice:"json" choice:"csv" default:"table" description:"Write the report out as a table, JSON, or CSV."`
+}
+
+type reportNameArgs struct {
+	Args struct {
+		Name string `positional-arg-name:"name"`
+	} `positional-args:"yes" required:"yes"`
 }
 
 func initConfig() *Conf { return &Conf{} }
@@ -72,7 +133,20 @@ func ParseConfigOptions() error {
 
 	parser.NamespaceDelimiter = "-"
 
-	_, err := parser.Parse()
+	reportOpts := &reportOptions{}
+	userArgs := &reportNameArgs{}
+	groupArgs := &reportNameArgs{}
+	reportCmd, err := parser.AddCommand("report", "Report on who has access where", "Report on who has access to which nodes, going by the group and user definitions in consul and what the nodes have published about themselves.", reportOpts)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	reportCmd.AddCommand("user", "Where a user has access", "Show every node the user has, or should have, an account on.", userArgs)
+	reportCmd.AddCommand("group", "Who can log into the nodes in a group", "Show every user who can log into the nodes that apply the group. The group can be given as its full key, or as its name under the group key prefix.", groupArgs)
+	reportCmd.AddCommand("drift", "Which nodes have drifted from the desired state", "Show every way the nodes differ from what the group and user definitions say they should look like.", &struct{}{})
+	parser.SubcommandsOptional = true
+
+	_, err = parser.Parse()
 	if err != nil {
 		if err.(*flags.Error).Type == flags.ErrHelp {
 			os.Exit(0)
@@ -86,6 +160,16 @@ func ParseConfigOptions() error {
 		os.Exit(0)
 	}
 
+	if parser.Active != nil && parser.Active.Name == "report" {
+		Config.Report = &ReportQuery{Kind: parser.Active.Active.Name, Format: reportOpts.Format}
+		switch Config.Report.Kind {
+		case "user":
+			Config.Report.Name = userArgs.Args.Name
+		case "group":
+			Config.Report.Name = groupArgs.Args.Name
+		}
+	}
+
 	if opts.ConfFile != "" {
 		if _, err := toml.DecodeFile(opts.ConfFile, Config); err != nil {
 			log.Println(err)
@@ -107,6 +191,16 @@ func ParseConfigOptions() error {
 		Config.UserKeyPrefix = defaultUserKeyPrefix
 	}
 
+	if opts.Daemon {
+		Config.Daemon = opts.Daemon
+	}
+	if opts.GroupKeyPrefix != "" {
+		Config.GroupKeyPrefix = opts.GroupKeyPrefix
+	}
+	if Config.GroupKeyPrefix == "" {
+		Config.GroupKeyPrefix = defaultGroupKeyPrefix
+	}
+
 	if opts.SysLog {
 		Config.SysLog = opts.SysLog
 	}
@@ -148,5 +242,81 @@ func ParseConfigOptions() error {
 		Config.StateFile = opts.StateFile
 	}
 
+	if opts.UserStateFile != "" {
+		Config.UserStateFile = opts.UserStateFile
+	}
+	if Config.UserStateFile == "" && Config.StateFile != "" {
+		Config.UserStateFile = Config.StateFile + ".users"
+	}
+
+	if opts.HomeArchiveDir != "" {
+		Config.HomeArchiveDir = opts.HomeArchiveDir
+	}
+	if Config.HomeArchiveDir == "" {
+		Config.HomeArchiveDir = defaultHomeArchiveDir
+	}
+
+	if opts.MergePolicy != "" {
+		Config.MergePolicy = opts.MergePolicy
+	}
+	mp, err := groups.ParseMergePolicy(Config.MergePolicy)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	Config.MergePolicy = string(mp)
+
+	if opts.OverrideLimit {
+		Config.OverrideLimit = opts.OverrideLimit
+	}
+	if opts.AccountBackend != "" {
+		Config.AccountBackend = opts.AccountBackend
+	}
+
+	if opts.Root != "" {
+		Config.Root = opts.Root
+	}
+	if Config.Root != "" {
+		if fi, err := os.Stat(Config.Root); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		} else if !fi.IsDir() {
+			log.Printf("root directory %s is not a directory", Config.Root)
+			os.Exit(1)
+		}
+	}
+
+	if opts.AuditLog != "" {
+		Config.AuditLog = opts.AuditLog
+	}
+	Config.VerifyAuditLog = opts.VerifyAuditLog
+
+	if Config.OverrideKey == "" {
+		Config.OverrideKey = defaultOverrideKey
+	}
+
+	if opts.SpqrKeyPrefix != "" {
+		Config.SpqrKeyPrefix = opts.SpqrKeyPrefix
+	}
+	if Config.SpqrKeyPrefix == "" {
+		Config.SpqrKeyPrefix = defaultSpqrKeyPrefix
+	}
+	if opts.PublishStatus {
+		Config.PublishStatus = opts.PublishStatus
+	}
+	if opts.Inventory {
+		Config.PublishInventory = opts.Inventory
+	}
+	if opts.NodeName != "" {
+		Config.NodeName = opts.NodeName
+	}
+
+	for _, pat := range Config.ProtectedProcesses {
+		if _, err := regexp.Compile(pat); err != nil {
+			log.Printf("invalid protected process pattern '%s': %s", pat, err.Error())
+			os.Exit(1)
+		}
+	}
+
 	return nil
 }
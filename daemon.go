@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/ctdk/spqr/config"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/tideland/golib/logger"
+	"time"
+)
+
+const (
+	// consul caps blocking queries at ten minutes anyway
+	maxDaemonWait   = 5 * time.Minute
+	daemonErrorWait = 10 * time.Second
+)
+
+// runDaemon watches the group key prefix in consul itself, rather than
+// relying on a consul watch to run spqr. Every group under the prefix is
+// processed whenever anything under the prefix changes, and again whenever a
+// group membership's validity window opens or closes.
+func runDaemon(c *consul.Client) {
+	prefix := config.Config.GroupKeyPrefix
+	logger.Infof("running as a daemon, watching '%s'", prefix)
+
+	var waitIndex uint64
+	var nextChange time.Time
+
+	for {
+		wait := maxDaemonWait
+		if !nextChange.IsZero() {
+			if untilNext := time.Until(nextChange); untilNext < wait {
+				wait = untilNext
+			}
+		}
+
+		var kvs consul.KVPairs
+		var meta *consul.QueryMeta
+		var err error
+
+		// Don't bother asking consul to wait if the next membership
+		// change is already due.
+		if wait > 0 {
+			opts := &consul.QueryOptions{WaitIndex: waitIndex, WaitTime: wait}
+			kvs, meta, err = c.KV().List(prefix, opts)
+			if err != nil {
+				logger.Errorf("error watching '%s': %s", prefix, err.Error())
+				time.Sleep(daemonErrorWait)
+				continue
+			}
+		}
+
+		changed := meta != nil && meta.LastIndex != waitIndex
+		due := !nextChange.IsZero() && !time.Now().Before(nextChange)
+		if !changed && !due {
+			continue
+		}
+		if meta == nil {
+			// the wait was skipped, so get the groups without
+			// blocking
+			kvs, meta, err = c.KV().List(prefix, nil)
+			if err != nil {
+				logger.Errorf("error fetching '%s': %s", prefix, err.Error())
+				time.Sleep(daemonErrorWait)
+				continue
+			}
+		}
+		// Per consul's docs, reset the index if it goes backwards.
+		if meta.LastIndex < waitIndex {
+			waitIndex = 0
+		} else {
+			waitIndex = meta.LastIndex
+		}
+
+		if changed {
+			logger.Debugf("'%s' changed, now at index %d", prefix, waitIndex)
+		} else {
+			logger.Infof("re-evaluating group memberships, a validity window changed at %s", nextChange.Format(time.RFC3339))
+		}
+
+		items := make([]*incomingItem, 0, len(kvs))
+		for _, kv := range kvs {
+			// skip any "directories"
+			if len(kv.Value) == 0 {
+				continue
+			}
+			item := &incomingItem{
+				key:         kv.Key,
+				createIndex: int64(kv.CreateIndex),
+				modifyIndex: int64(kv.ModifyIndex),
+				lockIndex:   int64(kv.LockIndex),
+				payload:     kv.Value,
+				kind:        keyPrefix,
+			}
+			items = append(items, item)
+		}
+
+		nextChange = processItems(c, items, true)
+		if !nextChange.IsZero() {
+			logger.Debugf("next membership validity change is at %s", nextChange.Format(time.RFC3339))
+		}
+	}
+}
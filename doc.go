@@ -34,13 +34,43 @@ The user definition JSON is structured like so:
 	  "shell": "/bin/sh",
 	  "authorized_keys": [
 	    "ssh-rsa AAAAAAAAAAA baz@q.local"
-	  ]
+	  ],
+	  "labels": {
+	    "team": "payments",
+	    "role": "oncall"
+	  }
 	}
 
-The mandatory fields are "username" and "action", although unless the user is being disabled "authorized_keys" is strongly recommended. Default values are filled in for "shell" ("/bin/bash") and "full_name" (set to "username"), while the default value for "primary_group" depends on the OS defaults for user primary groups (generally, it's a group named after the user, but it may not always be the case). The "action" is either ""create"" or ""disable"".
+The mandatory fields are "username" and "action", although unless the user is being disabled "authorized_keys" is strongly recommended. Default values are filled in for "shell" ("/bin/bash") and "full_name" (set to "username"), while the default value for "primary_group" depends on the OS defaults for user primary groups (generally, it's a group named after the user, but it may not always be the case). The "action" is ""create"", ""disable"", or ""delete"".
+
+The optional "uid" field gives the uid a new user is created with, which is handy for keeping uids the same across machines. It has no effect on existing users; spqr logs a warning if their uid doesn't match, but leaves it alone.
+
+The optional "labels" hash holds free-form string labels for the user. spqr doesn't use them for anything on its own, but group definitions can select their members by them (see below).
 
 These user definitions need to be stored in consul with a key that matches "USER_KEY_PREFIX/<username>". By default the user key prefix is "org/default/users", so the example above would be stored in "org/default/users/baz".
 
+Account expiry and password aging
+
+User definitions can also set an account expiry date and password aging settings, which are applied at the OS level with "chage" and so keep working even if spqr isn't running:
+
+	{
+	  "username": "contractor",
+	  "action": "create",
+	  "authorized_keys": [
+	    "ssh-rsa AAAAAAAAAAA contractor@q.local"
+	  ],
+	  "expires_at": "2018-12-31",
+	  "password_aging": {
+	    "max_days": 90,
+	    "warn_days": 7,
+	    "inactive_days": 30
+	  }
+	}
+
+"expires_at" is either a date ("2018-12-31"), an RFC 3339 timestamp, or "never" to remove an expiry date the account already has. The "password_aging" settings are the maximum number of days a password is valid, the number of days before that the user is warned, and the number of days after a password expires before the account is locked. Any of them may be left out.
+
+Each time a user is processed spqr compares these with what's in "/etc/shadow" and fixes anything that has drifted. Settings left out of the user definition aren't touched, so removing "expires_at" from a user definition doesn't remove the account's expiry date; set it to "never" instead.
+
 Groups
 
 NB: The groups discussed here are not the same as groups in the operating system. Having a user in a group called "ops" in "spqr" will not put the user in an OS group called "ops" on the system, unless you added it to the groups in the user definition.
@@ -79,20 +109,334 @@ Optionally, the group definition can also have an array of strings named "common
 
 NB: While duplicate OS groups in user group lists and in the "common_groups" list are fine, if a user is in two spqr groups on the same machine, one with common groups and one without, then that user will be added to/removed from those groups depending on which group was most recently processed. A possible case is where a user is in both the "developers" group and the "ops" group, where "ops" has "sysadmin" in the common group list. If "developers" is updated and processed after "ops" has been processed, then that user will be removed from "sysadmin". Should "ops" be processed by spqr again, they'd be added back to the group again. To avoid this issue, users should either a) not be put into more than one group that will be present on a machine, b) the user should have those common groups added to their user group list, or c) using the "common_groups" feature should be avoided.
 
+Selecting group members by label
+
+Rather than listing every member by hand, a group definition can select members by the "labels" in their user definitions with a "selector" hash:
+
+	{
+	  "members": [
+	    {
+	      "username": "bill",
+	      "status": "disabled"
+	    }
+	  ],
+	  "selector": {
+	    "team": "payments",
+	    "role": "oncall"
+	  }
+	}
+
+Every user definition under the user key prefix whose labels include all of the selector's labels with the same values is added to the group as an enabled member, and gets the group's "common_groups" like any other member. An empty selector selects nobody. The selector and the "members" list can be used together, and "members" may be left out entirely if there is a selector. If a user is both matched by the selector and listed in "members", the entry in "members" wins; in the example above, bill stays disabled even if their labels match the selector.
+
+Using a selector means spqr lists the entire user key prefix in consul when the group is processed, so the node's consul ACL token needs to be able to read the whole prefix rather than just the individual users.
+
+Time-bounded membership
+
+Each entry in a group's "members" array can have a "valid_from" and/or a "valid_until" timestamp, in RFC 3339 format:
+
+	{
+	  "members": [
+	    {
+	      "username": "foo",
+	      "status": "enabled",
+	      "valid_from": "2018-06-01T09:00:00Z",
+	      "valid_until": "2018-06-08T09:00:00Z"
+	    }
+	  ]
+	}
+
+Outside of that window the member is treated as if their status was "disabled". Either end of the window can be left out. The window includes "valid_from" itself, but ends just before "valid_until".
+
+When spqr is run by a consul watch, it can only notice that a window has opened or closed when the watch fires, which only happens when something in consul changes. To have memberships start and end on time, run spqr in daemon mode (see below), where it re-evaluates the groups when the next window opens or closes without waiting for a change in consul.
+
+Group defaults
+
+A group definition can also provide defaults for its members' accounts:
+
+	{
+	  "members": [
+	    {
+	      "username": "foo",
+	      "status": "enabled"
+	    }
+	  ],
+	  "default_shell": "/bin/zsh",
+	  "default_primary_group": "builders",
+	  "home_base": "/srv/home",
+	  "create_home": false
+	}
+
+	* "default_shell": the login shell for members whose user definition has no "shell".
+	* "default_primary_group": the primary group for members whose user definition has no "primary_group". The OS group is created if it doesn't exist.
+	* "home_base": the directory members' home directories are created in, when their user definition has no "home_dir". A member "foo" would get "/srv/home/foo" in the example above.
+	* "create_home": whether to create the home directory when the account is created. It defaults to "true", and can also be set in a user definition.
+
+Anything set in the user definition always wins over group defaults, and group defaults win over spqr's own defaults ("/bin/bash" for the shell, "/home" for the home directory base, and the OS defaults for the primary group). When a user is in more than one group setting the same default, the groups the user is listed in directly (or selected by) come before groups they're only in through an "include", and otherwise the groups are taken in order of their consul keys. The first group in that order to set a particular default wins. An included group's own defaults win over those of the group including it, and any defaults it doesn't set are taken from the including group.
+
+Group defaults only fill in fields in the user definition, so changing the default shell or primary group for a group will change them for existing members too the next time the group is processed. The home directory base and "create_home" only matter when an account is created.
+
+Nested groups
+
+A group definition can include other spqr groups with an "include" array of the included groups' keys:
+
+	{
+	  "members": [
+	    {
+	      "username": "foo",
+	      "status": "enabled"
+	    }
+	  ],
+	  "include": [
+	    "org/default/groups/dba"
+	  ]
+	}
+
+The members of every included group become members of the including group as well, and included groups' own includes are followed in turn. Members of an included group keep their own status and "common_groups", and also get the "common_groups" of the groups that include them. A user who is disabled in a group stays disabled in every group it includes, even if the included group has them enabled. A group that ends up including itself, whether directly or further down the chain, has that include skipped with a warning. If an included group can't be found or read, the whole including group is skipped for that run and an error is logged.
+
 While the only hard constraint with the key in consul for groups is that the group key must match the prefix (or name) the consul watch is watching on, a good convention to use is to use a key similar to the ones used with users along the lines of "org/default/groups/<group name>".
 
+Users in more than one group
+
+A user may be listed in more than one group on the same machine, possibly with different statuses. When that happens spqr settles the user's status with the membership merge policy, set with "membership-merge-policy" in the config file or "-m"/"--membership-merge-policy" on the command line:
+
+	* "enabled-wins" (the default): the user is enabled if any of their groups has them enabled.
+	* "disabled-wins": the user is disabled if any of their groups has them disabled.
+
+Each time the groups are merged spqr logs how it settled every user's status and which group entries it looked at. Users whose groups disagreed are logged at the "info" level, and the rest at the "debug" level.
+
 Disabling users
 
 If a user has the action "create", but their status in the group definition is "disabled", or if they're enabled in the group but marked as "disable" in the user definition, the user will be disabled. A user that is marked to be disabled that does not already exist on the system will not be created.
 
-When a user is disabled, their ssh authorized keys are removed, they are removed from all their secondary groups, their login shell is changed to "/sbin/nologin", their account is locked in case they set a password, and their processes are all killed. Their home directories are not removed, and they're still members of their primary group.
+When a user is disabled, their ssh authorized keys are removed, they are removed from all their secondary groups, their login shell is changed to "/sbin/nologin", their account is locked in case they set a password, and their processes are all ended. Their home directories are not removed, and they're still members of their primary group.
+
+Re-enabling users
+
+When a disabled user is set back to "create" and enabled in their groups, spqr re-enables them: their account is unlocked, an expiry date left over from being disabled is removed (unless the user definition sets "expires_at" itself), a home directory that was moved aside is moved back, and their shell, ssh keys, and groups are restored from their user definition. Re-enabling is logged separately from ordinary updates, along with the reasons spqr thought the user had been disabled.
+
+spqr decides a user needs re-enabling if the user state file (see below) recorded them as disabled or recorded that spqr expired their account, their shell is "/sbin/nologin", their home directory has been moved aside by a disable policy, their password is locked, or their account has expired. A password only counts as locked if there's a password under the lock, since accounts without a password (like the ones spqr creates) look locked from the start; keep in mind that a password locked by hand will be unlocked when the user is re-enabled. An expired account doesn't count if the user definition sets "expires_at" itself, since then the expiry is what's wanted. It doesn't matter whether the user was disabled by their status in a group, by the action in their user definition, or by hand, and a user state file isn't needed to notice any of these.
+
+Deleting users
+
+A user whose user definition has the action "delete" is deleted from the system. Before the account is removed with "userdel", any processes the user has running are killed and their home directory is archived to a gzipped tarball in the home archive directory ("/var/lib/spqr/archive" by default, set with "home-archive-dir" in the config file or "-A"/"--home-archive-dir"). The tarball is named after the user and the time it was made, like "foo-20180601090000.tar.gz", and is accompanied by a "foo-20180601090000.manifest.json" manifest listing the user's uid and gid, the original home directory, the SHA256 sum of the tarball, and every file in it with its mode, size, and SHA256 sum. If the home directory can't be archived the user is not deleted. Once the archive is written, "userdel" removes the home directory and mail spool along with the account.
+
+Disabled users can also be deleted automatically after they've been disabled for a while by setting "delete_after_days" in a disable policy (see below). To know how long a user has been disabled, spqr records when each user was first disabled in the user state file. This is set with "user-state-file" in the config file or "-u"/"--user-state-file", and defaults to the state file's path with ".users" added to the end. Without a state file or user state file, disabled users are never deleted automatically. A user who is enabled again before the time runs out has their disable time forgotten, and starts over if they're disabled again later.
+
+Disable policy
+
+What happens when a user is disabled can be changed with a disable policy, either for every user in the config file:
+
+	[disable-policy]
+	kill-processes = false
+	keep-groups = ["builders"]
+
+or for a group's members in the group definition:
+
+	{
+	  "members": [
+	    {
+	      "username": "deploy",
+	      "status": "disabled"
+	    }
+	  ],
+	  "disable_policy": {
+	    "kill_processes": false,
+	    "expire_account": true
+	  }
+	}
+
+The available settings are:
+
+	* "lock_password" ("lock-password" in the config file): lock the account's password. Defaults to "true".
+	* "nologin_shell" ("nologin-shell"): change the login shell to "/sbin/nologin". Defaults to "true".
+	* "delete_keys" ("delete-keys"): remove the user's ssh authorized keys. Defaults to "true".
+	* "clear_groups" ("clear-groups"): remove the user from their secondary groups. Defaults to "true".
+	* "keep_groups" ("keep-groups"): secondary groups the user stays in when their groups are cleared.
+	* "kill_processes" ("kill-processes"): kill all of the user's processes. Set this to "false" to keep their sessions and running jobs alive. Defaults to "true".
+	* "terminate_sessions" ("terminate-sessions"): before signalling the user's processes, ask systemd-logind to end their sessions with "loginctl terminate-user". This is skipped on systems without logind. Defaults to "true".
+	* "kill_grace_seconds" ("kill-grace-seconds"): how many seconds the user's processes get to exit after being sent "SIGTERM" before they're sent "SIGKILL". Defaults to "10".
+	* "expire_account" ("expire-account"): set the account's expiry date in "/etc/shadow" to the past. Defaults to "false".
+	* "move_home" ("move-home"): move the user's home directory aside, to a directory named like "/home/foo.spqr-disabled-20180601090000". Defaults to "false".
+	* "delete_after_days" ("delete-after-days"): delete the user, as if their action were "delete", once they've been disabled for this many days. Defaults to "0", which never deletes them.
+	* "notice_minutes" ("notice-minutes"): give the user this many minutes notice before they're disabled (see below). Defaults to "0", which disables them right away.
+
+Processes are ended in stages, so that programs like editors and database clients get a chance to clean up after themselves: first the user's logind sessions are terminated, then whatever's left is sent "SIGTERM", and whatever's still running once the grace period is over is sent "SIGKILL". On systems using cgroup v2, the user's "user-UID.slice" cgroup is killed all at once with "cgroup.kill" (or frozen and then killed, on kernels too old to have "cgroup.kill"), so nothing in it can fork its way out. A process is counted as the user's if its real, effective, saved, or filesystem uid is theirs, so setuid processes aren't missed. Every process spqr comes across is logged with its pid, its command line, and how it ended. Processes are ended the same way when a user is deleted.
+
+A group's disable policy takes precedence over the one in the config file, and any settings a group leaves out are taken from the config file's policy, and then from the defaults above. Disable policies in groups are settled the same way as the other group defaults when a user is in more than one group. A disabled user is put through their disable policy again on every run, so anything that didn't work the first time, or that's been put back since, like ssh keys added back to their account, is taken care of. A user who's recorded as disabled in the user state file, or who shows signs of being disabled already, isn't given notice again and isn't written to the audit log as being disabled again; only the steps that actually change something are.
+
+Giving notice before disabling
+
+For planned offboarding, a disable policy can give users notice before they're disabled with "notice_minutes". The first time spqr sees that a user with a notice period should be disabled, it records when they're due to be disabled in the user state file, and writes a message to every terminal the user is logged in on according to utmp with the reason and the deadline. The user is only actually disabled once the deadline has passed. In daemon mode spqr wakes up to disable them on time. When spqr is run by a consul watch it can't do that, since the watch only runs spqr when something in consul changes; the user is disabled the next time the watch fires after the deadline, even if the change was to some other group and the user's own groups were skipped as unchanged. Run spqr in daemon mode if notice periods need to end on time. If the user is enabled again before then, the scheduled disable is dropped. The reason comes from "disable_reason" in the user definition:
+
+	{
+	  "username": "foo",
+	  "full_name": "Foo Bar",
+	  "action": "create",
+	  "disable_reason": "last day at the company"
+	}
+
+A user state file is needed to keep track of the notice period; without one users are disabled right away. Users who need to be cut off immediately can be given the action "revoke" in their user definition instead, which disables them at once no matter what notice their disable policy would give them.
+
+Inactive accounts
+
+Each time spqr runs, it logs when every existing user it manages last logged in, going by "/var/log/wtmp" (and "/var/log/wtmp.1", if it's still around) and "/var/log/lastlog", whichever has the most recent login.
+
+spqr can also disable users who haven't logged in for too long. Set "disable-after-inactive-days" in the config file to the number of days a user may go without logging in, or set "disable_after_inactive_days" in a group definition to do it for just that group's members (a group setting of "0" turns it off for the group). Groups settle this the same way as their other defaults. A user's inactivity is counted from their last login, or from when their password was last changed in "/etc/shadow" if that's more recent, which for an account that's never had a password is when it was created. Inactive users are disabled like any other disabled user, including any notice their disable policy gives them, and the user state file records "inactive" as the reason they were disabled.
+
+Since an inactive user can't log in to become active again, a user disabled for inactivity stays disabled even if their groups still say they're enabled. To bring them back, set "reactivated_at" in their user definition to the date (or RFC 3339 timestamp) they were reactivated; their inactivity is counted from then, so they'll be re-enabled and have the usual number of days to log in again.
+
+	{
+	  "username": "foo",
+	  "full_name": "Foo Bar",
+	  "action": "create",
+	  "reactivated_at": "2018-06-01"
+	}
+
+Protected users and processes
+
+Some accounts are never created, modified, disabled, or deleted by spqr, no matter what the group and user definitions say: root, any account whose uid is below "UID_MIN" or above "UID_MAX" in "/etc/login.defs" (1000 and 60000 if they aren't set there), which covers system and service accounts along with the likes of "nobody", and any users listed in "protected-users" in the config file. Users that don't exist yet are protected the same way if their user definition gives them a uid outside that range, so a definition can't be used to create an account with a system uid; otherwise they can only be protected by name. spqr logs a warning and moves on when a group tries to do anything to a protected user, so a bad edit to a group naming a system account can't wreck a host.
+
+Processes can be protected as well, with a list of regular expressions in "protected-process-patterns". A process whose command line matches one of them is never killed when its user is disabled or deleted, and is logged as left alone. When a user has a protected process running, their logind sessions aren't terminated and their cgroup isn't killed all at once either, since both would take it down too.
+
+	protected-users = ["deploy", "backup"]
+	protected-process-patterns = ["^/usr/sbin/sshd", "pg_dump"]
+
+Limiting how many users a run can disable
+
+To keep a bad bulk edit or a truncated group definition from locking a whole team out across every machine at once, spqr can refuse to apply a run that would disable or delete too many users. Before changing anything, spqr works out how many users the run would newly disable or delete, including disabled users whose time is up under "delete_after_days". Users who are already disabled and protected users aren't counted. If that's more than "max-disable-count" users, or more than "max-disable-percent" percent of all of the users spqr manages on the machine (the members of all of its groups, including groups that haven't changed since they were last applied), nothing at all is changed and an error is logged listing the users involved. Both limits default to "0", which means no limit.
+
+	max-disable-count = 5
+	max-disable-percent = 20.0
+
+When a large change is intended, the limit can be overridden by creating the key "org/default/spqr/override-blast-radius" in consul (set a different key with "blast-radius-override-key" in the config file). The key's value doesn't matter. Every node shares the key, so spqr doesn't remove it; instead each node remembers the key's "ModifyIndex" in the user state file once the key has let a run through, and won't let another run through until the key is set again. That way one override lets a fleet-wide change through on every node, once. Without a user state file there's nowhere to remember that, so the key overrides the limit on every run until it's removed. The limit can also be overridden on the command line with "-O"/"--override-blast-radius", or with "override-blast-radius = true" in the config file, but keep in mind that in daemon mode that lets every run through.
+
+Account backends
+
+spqr creates, changes, locks, and removes accounts and groups through an account backend, chosen with "account-backend" in the config file or "-B"/"--account-backend" on the command line. The available backends are:
+
+	* "shadow-utils" (the default): manages accounts with "useradd", "usermod", "userdel", "groupadd", "chage", and "passwd" from shadow-utils.
+	* "busybox": manages accounts with the "adduser", "deluser", "addgroup", "delgroup", and "passwd" applets from BusyBox, for Alpine and other hosts without shadow-utils. BusyBox has no "usermod" or "chage", so spqr works out which groups to add users to and remove them from itself, and edits "/etc/passwd" and "/etc/shadow" directly (in the same way as the "files" backend) to change account details and aging. This backend is picked automatically when "account-backend" isn't set and shadow-utils isn't installed.
+	* "files": edits "/etc/passwd", "/etc/group", "/etc/shadow", and "/etc/gshadow" (if present) directly, without running any other programs. This is handy on minimal images without shadow-utils, and is a lot faster when a run touches many users. It takes the same lock "lckpwdf(3)" does while it works, so it won't trample on shadow-utils or anything else editing the files at the same time. Each file is replaced atomically, and the previous version is kept as a backup ("/etc/passwd-" and so on), like shadow-utils does. New uids and gids are picked from "UID_MIN"-"UID_MAX" and "GID_MIN"-"GID_MAX" in "/etc/login.defs", new users get a group of their own unless they have a primary group, and new home directories are filled in from "/etc/skel".
+	* "extrausers": rather than making local accounts, keeps the users and groups spqr manages in "/var/lib/extrausers/passwd", "group", and "shadow" for "libnss-extrausers" to serve up. This keeps them entirely apart from the accounts that came with the base image, and getting rid of all of them is as easy as removing those files. Otherwise it works just like the "files" backend, with the same locking, atomic writes, and backups. Every user definition must have a "uid", so users have the same uid everywhere, and it mustn't clash with a local account. New groups get the first free gid that isn't used by a local group either. Users can't be added to local groups from "/etc/group"; spqr logs a warning and skips those. "extrausers" needs to be added to the "passwd", "group", and "shadow" lines in "/etc/nsswitch.conf" for the system to see these users, and spqr warns if it isn't.
+	* "memory": keeps accounts and groups in memory rather than on the system, so nothing it does lasts past the run. Home directories and ssh keys are still written under the root directory, but nothing is chowned. It's meant for trying out group and user definitions, with "-R"/"--root" pointed at a scratch directory, and for testing spqr itself.
+
+Managing users under another root directory
+
+spqr can set up users in a filesystem tree other than the running system's, like a chroot, a container's root filesystem, or a mounted disk image, which is handy for baking users into images. Give the directory with "-R"/"--root" on the command line (or "root" in the config file), and the users, groups, and ssh keys from consul are applied under it instead. The "shadow-utils" backend runs its commands with "--root", and the "files" and "extrausers" backends edit the files under that directory; the "busybox" backend can't be used this way. "/etc/login.defs" is read from under the root directory too.
+
+Since nobody can be logged in to a directory tree, processes are never killed there, disabled users aren't given any notice, and the inactive account check is skipped. spqr doesn't manage sudoers itself, so any sudo access comes from the groups users are put in, the same as on a running system. The user state file and home archive directory are still on the machine running spqr.
+
+Commands spqr runs
+
+Every outside command spqr runs to change the system, like "useradd", "usermod", "passwd", "groupadd", and "loginctl", goes through the same place. Each one is logged at the "info" level (or "warning", if it failed) with its full arguments, exit code, and how long it took, and whatever it printed is logged at the "debug" level. At the end of each run spqr logs how many commands it ran and lists any that failed. When there's an audit log, every command is written to it as well (see below). A command that runs for longer than "command-timeout" seconds in the config file (60 by default) is killed and treated as having failed, so a hung command can't hold up spqr forever.
+
+Audit log
+
+spqr can keep an audit log of every change it makes to users, for feeding to a SIEM or for answering questions about who changed what later. Set "audit-log" in the config file (or "-a"/"--audit-log" on the command line) to the path of the log. Each change is appended to it as a line of JSON, like:
+
+	{"time":"2018-06-01T09:00:00.123456789Z","run_id":"845f4770d8560f95","host":"web01","user":"baz","change":"groups","consul_key":"org/default/groups/sysadmins","modify_index":1234,"removed":["wheel"],"prev_hash":"0914f2b2...","hash":"e23866d9..."}
+
+Every entry has the time, the ID of the spqr run that made the change (also logged at the end of each run), the host, the user, and the kind of change. Where the change came from a group in consul, the group's key and its "ModifyIndex" at the time are included. The kinds of changes, and what else is recorded for them, are:
+
+	* "create": the new user's "uid", and their groups in "added".
+	* "key_added" and "key_removed": the SHA256 "fingerprint" of the ssh key, as "ssh-keygen -l" would show it.
+	* "groups": the secondary groups "added" and "removed".
+	* "primary_group", "shell", and "name": what it changed "from" and "to".
+	* "disable": the "reason" the user was disabled, if there was one.
+	* "reenable": the signs that the user had been disabled, as the "reason".
+	* "processes_killed": the "pids" of the processes that were ended.
+	* "delete": the "archive" the home directory was archived to.
+	* "command": an outside command spqr ran to make a change, like "useradd" or "passwd", in "command". It has the "command" and its "args", when it was "started", its "duration" in nanoseconds, its "exit_code", whether it "timed_out", its "stdout" and "stderr" (cut off after 4KB), and the "error" if it failed. Commands aren't tied to a user, so "user" is left empty.
+
+Each entry also has the hash of the entry before it in "prev_hash", and its own SHA256 hash in "hash", so changing, removing, or reordering entries after the fact breaks the chain. Run "spqr --verify-audit-log=<path>" to check the whole chain; it exits with an error naming the first entry that doesn't check out. If the audit log is configured but can't be opened, spqr leaves all users alone rather than make changes that aren't recorded. Nothing is logged when nothing changes, so the audit log doesn't grow with every run.
+
+Publishing node status
+
+With "publish-status" turned on in the config file (or "--publish-status" on the command line), spqr writes how each run went to "<spqr-key-prefix>/nodes/<node name>/status" in consul when it's done, so you can see whether the whole fleet has caught up with a change without logging into every machine. The spqr key prefix defaults to "org/default/spqr", and can be changed with "spqr-key-prefix" or "-k"/"--spqr-key-prefix". The node name is the consul agent's node name, unless it's set with "node-name" or "-N"/"--node-name". The status looks like:
+
+	{
+	  "node": "web01",
+	  "spqr_version": "0.1.0",
+	  "git_hash": "a1b2c3d",
+	  "run_id": "845f4770d8560f95",
+	  "last_run": "2018-06-01T09:00:00.123456789Z",
+	  "duration_seconds": 1.52,
+	  "succeeded": false,
+	  "errors": [
+	    "Error attempting to create user qux: exit status 9"
+	  ],
+	  "group_indices": {
+	    "org/default/groups/sysadmins": 1234,
+	    "org/default/groups/developers": 1240
+	  },
+	  "users": {
+	    "baz": { "action": "create", "result": "ok" },
+	    "qux": { "action": "create", "result": "failed", "error": "Error attempting to create user qux: exit status 9" },
+	    "quux": { "action": "disable", "result": "pending" }
+	  },
+	  "commands": {
+	    "ran": 4,
+	    "duration_seconds": 0.31,
+	    "failed": [
+	      {
+	        "command": "useradd",
+	        "args": [ "-m", "-s", "/bin/bash", "-G", "sysadmins", "qux" ],
+	        "started": "2018-06-01T09:00:00.623456789Z",
+	        "duration": 21000000,
+	        "exit_code": 9,
+	        "stderr": "useradd: username 'qux' is already in use\n",
+	        "error": "exit status 9 :: useradd: username 'qux' is already in use\n"
+	      }
+	    ]
+	  }
+	}
+
+"group_indices" has the "ModifyIndex" of each of the node's group keys, so you can tell which version of a group a node has applied. Groups that were skipped because they hadn't changed since they were last applied are included, with the index they were applied at, so the status always covers all of the node's groups. Each user's "result" is one of:
+
+	* "ok": the user is as they should be.
+	* "failed": something went wrong; the error is in "error".
+	* "pending": the user is being given notice before they're disabled.
+	* "protected": the user is protected, so spqr left them alone.
+	* "absent": the user was to be disabled or deleted, but didn't exist.
+	* "skipped": an earlier user failed, so spqr stopped before getting to this one.
+
+"commands" says how many outside commands spqr ran to change the system and how long they took in all, and lists the ones that failed with their arguments, exit code, how long they took, and whatever they printed. It's left out if nothing was run.
+
+The node's ACL token needs write access to its status key. If the status can't be published, spqr logs an error but otherwise carries on.
+
+Publishing node inventory
+
+The status only says whether spqr thinks it did what it was told. To see what the accounts on a node actually look like, turn on "publish-inventory" in the config file (or "--publish-inventory" on the command line). After each run spqr then looks up every user in the groups it was given, along with anyone it still remembers in the user state, and writes what it finds to "<spqr-key-prefix>/nodes/<node name>/inventory":
+
+	{
+	  "node": "web01",
+	  "run_id": "845f4770d8560f95",
+	  "updated": "2018-06-01T09:00:01.654321Z",
+	  "users": [
+	    {
+	      "username": "baz",
+	      "uid": "1001",
+	      "full_name": "Baz Quux",
+	      "home_dir": "/home/baz",
+	      "shell": "/bin/bash",
+	      "primary_group": "baz",
+	      "groups": [ "sysadmins", "wheel" ],
+	      "key_fingerprints": [ "SHA256:qhNHJFvGnAeb7a0AbjCxRKzryOOX0kno/LDvgS9OM80" ],
+	      "enabled": true,
+	      "last_login": "2018-05-31T16:42:10Z",
+	      "last_login_from": "wtmp, on pts/0 from 10.0.0.5"
+	    }
+	  ]
+	}
+
+The inventory comes from the accounts themselves, the same way spqr looks users up before changing them, rather than from the user definitions. A user counts as disabled if their login shell is "/sbin/nologin", their home directory has been moved aside, their account has expired, or the user state says they were disabled; the signs are listed in "disabled_signs". Users who don't exist on the node are left out. Key fingerprints are SHA256 fingerprints, as "ssh-keygen -l" shows them, so the keys themselves aren't copied around. "last_login" is when the user last logged in according to "/var/log/wtmp" or "/var/log/lastlog", whichever is more recent, and "last_login_from" says which one it came from, along with the terminal and host if they were recorded. Both are left out for users who have never logged in, and on systems other than linux.
 
 Usage
 
 spqr has several command line options when it's run:
 
 	Usage:
-	  spqr [OPTIONS]
+	  spqr [OPTIONS] [report]
 
 	Application Options:
 	  -v, --version           Print version info.
@@ -114,14 +458,83 @@ spqr has several command line options when it's run:
 	  -s, --statefile=        Store spqr's state in this file.
 	  -V, --verbose           Show verbose debug information. Repeat for more
 				  verbosity.
+	  -u, --user-state-file=  Store per-user state, like when users were disabled,
+				  in this file. Defaults to the state file's path with
+				  '.users' added to the end, if there is a state file.
+	  -A, --home-archive-dir= Archive home directories of deleted users to this
+				  directory. Default value: '/var/lib/spqr/archive'.
+	  -D, --daemon            Run as a daemon that watches the group key prefix in
+				  consul itself, rather than being run by a consul
+				  watch. [$SPQR_DAEMON]
+	  -G, --group-key-prefix= Consul key prefix for the groups to watch when
+				  running as a daemon. Default value:
+				  'org/default/groups'. [$SPQR_GROUP_KEY_PREFIX]
+	  -O, --override-blast-radius
+				  Go ahead with a run even if it would disable or
+				  delete more users than the configured limits allow.
+	  -B, --account-backend=  How to manage accounts on this machine. Default
+				  value: 'shadow-utils', or 'busybox' if shadow-utils
+				  isn't installed. [$SPQR_ACCOUNT_BACKEND]
+	  -R, --root=             Manage the users in the filesystem tree under this
+				  directory, like a chroot or a mounted disk image,
+				  rather than on the running system. [$SPQR_ROOT]
+	  -a, --audit-log=        Append a JSON record of every change made to users
+				  to this file. [$SPQR_AUDIT_LOG]
+	      --verify-audit-log=
+				  Check that the audit log at this path hasn't been
+				  tampered with, and exit.
+	  -k, --spqr-key-prefix=  Consul key prefix for what spqr publishes about the
+				  nodes it runs on. Default value: 'org/default/spqr'.
+				  [$SPQR_KEY_PREFIX]
+	      --publish-status    After each run, publish how it went to the node's
+				  status key under the spqr key prefix.
+				  [$SPQR_PUBLISH_STATUS]
+	      --publish-inventory
+				  After each run, publish what the accounts spqr
+				  manages actually look like to the node's inventory
+				  key under the spqr key prefix.
+				  [$SPQR_PUBLISH_INVENTORY]
+	  -N, --node-name=        Publish this node's status and inventory under this
+				  name. Defaults to the consul agent's node name.
+				  [$SPQR_NODE_NAME]
+	  -m, --membership-merge-policy=
+				  How to settle a user's status when they're in more
+				  than one group with different statuses. Acceptable
+				  values are 'enabled-wins' (the default) and
+				  'disabled-wins'. [$SPQR_MEMBERSHIP_MERGE_POLICY]
 
 	Help Options:
 	  -h, --help              Show this help message
 
+	Available commands:
+	  report  Report on who has access where
+
 On the command line, spqr needs to be run in the consul watch like this:
 
 	consul watch -type=keyprefix -prefix=<path/to/group> spqr [OPTIONS]
 
+Daemon mode
+
+Alternatively, spqr can watch consul itself by running it as a daemon with "-D"/"--daemon" (or "daemon = true" in the config file):
+
+	spqr -D -G <path/to/group> [OPTIONS]
+
+In daemon mode spqr watches the group key prefix given with "-G"/"--group-key-prefix" ("org/default/groups" by default), and processes every group under it whenever anything under the prefix changes. It also re-evaluates the groups whenever a time-bounded group membership starts or ends, even if nothing in consul has changed.
+
+
+Access reports
+
+"spqr report" answers questions about who has access where, using the group and user definitions in consul and whatever the nodes have published with "publish-status" and "publish-inventory". It only reads from consul, so it can be run from anywhere that can reach it, and doesn't need to run as root. It takes the same "-C", "-P", "-G", "-k", and "-m" options (or config file settings) as spqr itself, to find everything. There are three reports:
+
+	spqr [OPTIONS] report [-f table|json|csv] user <username>
+	spqr [OPTIONS] report [-f table|json|csv] group <group>
+	spqr [OPTIONS] report [-f table|json|csv] drift
+
+	* "user" shows every node the user has, or should have, an account on. For each node it shows what the user's account should be ("enabled", "disabled", "deleted", or "undefined" if they're in a group but have no user definition) going by the groups the node applied in its last run, and what the node's inventory says it actually is ("enabled", "disabled", "absent", or "unknown" if the node hasn't published an inventory), along with the groups that give the user access.
+	* "group" shows every user who can actually log into the nodes that applied the group in their last run, either directly or because one of their other groups includes it. The group can be given as its full key, or as its name under the group key prefix. Nodes that haven't published an inventory are logged as warnings, since who can log into them isn't known.
+	* "drift" shows every way the nodes differ from what they're supposed to look like: nodes whose last run failed, nodes that haven't applied the latest version of one of their groups, users who should be enabled but have no account or are disabled, users who should be disabled or deleted but aren't, users whose ssh keys don't match their user definition, and enabled users who aren't in any of the node's groups any more. Nodes that haven't published a status or inventory are listed too.
+
+The default output is a table. "-f json" gives the same information as JSON, and "-f csv" as CSV with a header row; in both the table and CSV, lists are separated by spaces. What a node is supposed to look like is worked out from the groups as they are in consul now, so a node that hasn't caught up with a change to one of its groups will show up as having drifted until it does.
 
 Platforms
 
@@ -21,11 +21,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/ctdk/spqr/config"
+	"github.com/ctdk/spqr/internal/audit"
+	"github.com/ctdk/spqr/internal/command"
 	"github.com/ctdk/spqr/internal/groups"
 	"github.com/ctdk/spqr/internal/state"
 	"github.com/ctdk/spqr/internal/users"
 	consul "github.com/hashicorp/consul/api"
 	"github.com/tideland/golib/logger"
+	"time"
 )
 
 const (
@@ -39,12 +42,22 @@ var handleDesc = map[uint8]string{
 	consulEvent: "event",
 }
 
-func handleIncoming(c *consul.Client, stateHolder *state.State, incomingCh chan *state.Indices, keys []interface{}) {
-	var handlingType uint8
-	var groupLists [][]*groups.Member
+// incomingItem is a single key or event to process, whether it came from a
+// consul watch on stdin or from spqr watching consul itself.
+type incomingItem struct {
+	key         string
+	createIndex int64
+	modifyIndex int64
+	lockIndex   int64
+	payload     []byte
+	kind        uint8
+}
 
-	idxIncoming := make([]*state.Indices, 0, len(keys))
-	logger.Debugf("Number of keys incoming: %d", len(keys))
+// parseIncoming turns the JSON a consul watch hands spqr on stdin into
+// incomingItems.
+func parseIncoming(keys []interface{}) []*incomingItem {
+	var handlingType uint8
+	items := make([]*incomingItem, 0, len(keys))
 
 	for _, k := range keys {
 		switch k := k.(type) {
@@ -52,22 +65,6 @@ func handleIncoming(c *consul.Client, stateHolder *state.State, incomingCh chan
 			logger.Debugf("what I expected: %+v", k)
 			var payload string
 
-			if stateHolder != nil {
-				cidx, _ := k["CreateIndex"].(json.Number).Int64()
-				midx, _ := k["ModifyIndex"].(json.Number).Int64()
-				lidx, _ := k["LockIndex"].(json.Number).Int64()
-				if !stateHolder.DoProcessIncoming(cidx, midx) {
-					continue
-				}
-				idx := new(state.Indices)
-				idx.CreateIndex = cidx
-				idx.ModifyIndex = midx
-				idx.LockIndex = lidx
-				idxIncoming = append(idxIncoming, idx)
-			} else {
-				logger.Debugf("erm, stateHolder is nil, but shouldn't be.")
-			}
-
 			// within one request, everything will be just one kind
 			// of thing so this only needs to be checked once.
 			if handlingType == notAThing {
@@ -98,61 +95,209 @@ func handleIncoming(c *consul.Client, stateHolder *state.State, incomingCh chan
 
 			val, err := base64.StdEncoding.DecodeString(payload)
 			if err != nil {
-				logger.Errorf(err.Error())
+				logger.Errorf("%s", err.Error())
+			}
+
+			item := &incomingItem{payload: val, kind: handlingType}
+			item.key, _ = k["Key"].(string)
+			if n, ok := k["CreateIndex"].(json.Number); ok {
+				item.createIndex, _ = n.Int64()
+			}
+			if n, ok := k["ModifyIndex"].(json.Number); ok {
+				item.modifyIndex, _ = n.Int64()
+			}
+			if n, ok := k["LockIndex"].(json.Number); ok {
+				item.lockIndex, _ = n.Int64()
+			}
+			items = append(items, item)
+		default:
+			logger.Errorf("NOT what I expected: %T %v", k, k)
+		}
+	}
+
+	return items
+}
+
+// handleIncoming processes the incoming items. Items the state says have
+// already been processed are skipped unless force is set. It returns the next
+// time a group membership's validity window opens or closes or a scheduled
+// disable is due, or the zero time if there's no such change coming.
+func handleIncoming(c *consul.Client, stateHolder *state.State, incomingCh chan *state.Indices, items []*incomingItem, force bool) time.Time {
+	var handlingType uint8
+	var groupLists [][]*groups.Member
+	// groups that haven't changed since they were last applied
+	var unchangedLists [][]*groups.Member
+
+	runID := audit.NewRunID()
+	logger.Debugf("starting run %s", runID)
+	status := newNodeStatus(runID, time.Now())
+
+	// keep track of every command run to make changes this time around
+	report := command.NewReport()
+	command.AddRecorder(report)
+	defer command.RemoveRecorder(report)
+
+	idxIncoming := make([]*state.Indices, 0, len(items))
+	uc := users.NewUserExtDataClient(c, config.Config.UserKeyPrefix, config.Config.DisablePolicy, config.Config.InactiveDays)
+	gp := newGroupParser(c, uc, status.LastRun)
+	logger.Debugf("Number of keys incoming: %d", len(items))
+
+	for _, item := range items {
+		var unchanged bool
+		if stateHolder != nil {
+			if !force && !stateHolder.DoProcessIncoming(item.createIndex, item.modifyIndex) {
+				// Already applied, but still one of this node's
+				// groups as far as its status goes. Its members
+				// aren't processed again, but they're still counted
+				// as users this node manages.
+				if item.kind == keyPrefix {
+					gp.indices[item.key] = uint64(item.modifyIndex)
+				}
+				unchanged = true
+			} else {
+				idx := new(state.Indices)
+				idx.CreateIndex = item.createIndex
+				idx.ModifyIndex = item.modifyIndex
+				idx.LockIndex = item.lockIndex
+				idxIncoming = append(idxIncoming, idx)
 			}
+		}
+		if !unchanged {
+			handlingType = item.kind
+		}
 
-			j := make(map[string]interface{})
-			err = json.Unmarshal([]byte(val), &j)
+		j := make(map[string]interface{})
+		err := json.Unmarshal(item.payload, &j)
+		if err != nil {
+			logger.Errorf("%s", err.Error())
+			continue
+		}
+		logger.Debugf("this is a %s", handleDesc[item.kind])
+		switch item.kind {
+		case keyPrefix:
+			def, err := gp.parse(item.key, uint64(item.modifyIndex), j)
 			if err != nil {
-				logger.Errorf(err.Error())
+				logger.Errorf("%s", err.Error())
+				status.fail(err)
 				continue
 			}
-			logger.Debugf("this is a %s", handleDesc[handlingType])
-			switch handlingType {
-			case keyPrefix:
-				var commonGroups []string
-				if cg, ok := j["common_groups"].([]interface{}); ok && len(cg) > 0 {
-					commonGroups = make([]string, len(cg))
-					for i, gg := range cg {
-						if c, cok := gg.(string); cok {
-							commonGroups[i] = c
-						}
-					}
-				}
-				convUsers, err := convertUsersInterfaceSlice(j["members"].([]interface{}), commonGroups)
-				if err != nil {
-					logger.Errorf(err.Error())
-					continue
-				}
+			convUsers, err := groups.ExpandIncludes(def, gp.fetch)
+			if err != nil {
+				logger.Errorf("%s", err.Error())
+				status.fail(err)
+				continue
+			}
+			if unchanged {
+				unchangedLists = append(unchangedLists, convUsers)
+			} else {
 				groupLists = append(groupLists, convUsers)
-			default:
-				logger.Debugf("not handling %s yet in switch", handleDesc[handlingType])
 			}
 		default:
-			logger.Errorf("NOT what I expected: %T %v", k, k)
+			logger.Debugf("not handling %s yet in switch", handleDesc[handlingType])
+		}
+	}
+
+	var userState *state.UserState
+	if config.Config.UserStateFile != "" && (handlingType == keyPrefix || len(unchangedLists) > 0) {
+		us, serr := state.LoadUserState(config.Config.UserStateFile)
+		if serr != nil {
+			logger.Errorf("could not load user state from %s: %s", config.Config.UserStateFile, serr.Error())
+			status.fail(serr)
 		}
+		userState = us
+	}
+
+	// Users whose notice has run out need to be disabled even if none of
+	// their groups have changed.
+	if due := dueForDisable(unchangedLists, userState, status.LastRun); len(due) > 0 {
+		logger.Debugf("%d users in unchanged groups are due to be disabled", len(due))
+		groupLists = append(groupLists, due)
+		handlingType = keyPrefix
 	}
 
 	// So what do we do?
 	switch handlingType {
 	case keyPrefix:
-		if u2get, err := groups.RemoveDupeUsers(groupLists); err != nil {
-			logger.Errorf(err.Error())
+		if u2get, decisions, err := groups.RemoveDupeUsers(groupLists, groups.MergePolicy(config.Config.MergePolicy)); err != nil {
+			logger.Errorf("%s", err.Error())
+			status.fail(err)
 		} else {
-			uc := users.NewUserExtDataClient(c, config.Config.UserKeyPrefix)
+			for _, d := range decisions {
+				if d.Conflict() {
+					logger.Infof("membership merge (%s): %s", d.Policy, d)
+				} else {
+					logger.Debugf("membership merge (%s): %s", d.Policy, d)
+				}
+			}
 			usarz, e := uc.GetUsers(u2get)
 			if e != nil {
-				logger.Errorf(e.Error())
+				logger.Errorf("%s", e.Error())
+				status.fail(e)
+			}
+			opts := &users.ProcessOptions{ArchiveDir: config.Config.HomeArchiveDir, Results: status.Users}
+			opts.Managed = countManaged(groupLists, unchangedLists)
+			opts.UserState = userState
+			prot, perr := users.NewProtection(config.Config.ProtectedUsers, config.Config.ProtectedProcesses)
+			if perr != nil {
+				logger.Errorf("could not work out which users and processes are protected, so leaving all users alone: %s", perr.Error())
+				status.fail(perr)
+				break
+			}
+			opts.Protection = prot
+			if config.Config.AuditLog != "" {
+				al, aerr := audit.Open(config.Config.AuditLog, runID)
+				if aerr != nil {
+					logger.Errorf("could not open the audit log %s, so leaving all users alone: %s", config.Config.AuditLog, aerr.Error())
+					status.fail(aerr)
+					break
+				}
+				defer al.Close()
+				opts.Audit = al
+				cr := al.CommandRecorder()
+				command.AddRecorder(cr)
+				defer command.RemoveRecorder(cr)
+			}
+			opts.BlastRadius = &users.BlastRadius{
+				MaxCount:   config.Config.MaxDisableCount,
+				MaxPercent: config.Config.MaxDisablePercent,
+				Override:   func() bool { return blastRadiusOverridden(c, opts.UserState) },
 			}
-			perr := users.ProcessUsers(usarz)
+			perr = users.ProcessUsers(usarz, opts)
 			if perr != nil {
-				logger.Errorf(perr.Error())
+				logger.Errorf("%s", perr.Error())
+				status.fail(perr)
+			}
+			if next := opts.UserState.NextDisableDue(); !next.IsZero() {
+				gp.noteChange(next)
+				if !config.Config.Daemon {
+					logger.Infof("users with notice running out at %s will be disabled the next time spqr runs after that; in daemon mode spqr would wake up to disable them on time", next.Format(time.RFC3339))
+				}
+			}
+			if serr := opts.UserState.Save(); serr != nil {
+				logger.Errorf("could not save user state to %s: %s", config.Config.UserStateFile, serr.Error())
+				status.fail(serr)
 			}
+			publishInventory(c, runID, u2get, opts.UserState)
 		}
+	case notAThing:
+		logger.Debugf("nothing to process")
 	default:
 		logger.Infof("not handling events (or anything else besides key prefix watches) yet")
 	}
 
+	if handlingType == keyPrefix {
+		status.GroupIndices = gp.indices
+		status.noteCommands(report)
+		status.publish(c)
+	}
+
+	if len(report.Commands) > 0 {
+		logger.Infof("Done processing users in run %s: %s", runID, report.Summary())
+		for _, r := range report.Failed() {
+			logger.Warningf("Failed: %s: %s", r, r.Error)
+		}
+	}
+
 	// Send any index updates to the state to process
 	if stateHolder != nil {
 		for _, idx := range idxIncoming {
@@ -160,9 +305,150 @@ func handleIncoming(c *consul.Client, stateHolder *state.State, incomingCh chan
 		}
 		close(incomingCh)
 	}
+
+	return gp.nextChange
+}
+
+// dueForDisable picks out the entries in groups that haven't changed for the
+// users whose notice period has run out, so they can be disabled anyway.
+func dueForDisable(lists [][]*groups.Member, us *state.UserState, now time.Time) []*groups.Member {
+	var due []*groups.Member
+	for _, l := range lists {
+		for _, m := range l {
+			rec := us.Get(m.Username)
+			if rec != nil && !rec.DisableDue.IsZero() && !now.Before(rec.DisableDue) {
+				due = append(due, m)
+			}
+		}
+	}
+	return due
+}
+
+// countManaged counts the users in all of the given groups, which are all of
+// the node's groups whether they changed this run or not.
+func countManaged(lists ...[][]*groups.Member) int {
+	seen := make(map[string]bool)
+	for _, l := range lists {
+		for _, g := range l {
+			for _, m := range g {
+				seen[m.Username] = true
+			}
+		}
+	}
+	return len(seen)
+}
+
+// groupParser parses group definitions for a single run, keeping track of the
+// next time any membership's validity window opens or closes.
+type groupParser struct {
+	c          *consul.Client
+	uc         *users.UserExtDataClient
+	now        time.Time
+	nextChange time.Time
+	indices    map[string]uint64
+}
+
+func newGroupParser(c *consul.Client, uc *users.UserExtDataClient, now time.Time) *groupParser {
+	return &groupParser{c: c, uc: uc, now: now, indices: make(map[string]uint64)}
+}
+
+// parse parses a group definition. The ModifyIndex of the group's key is
+// noted on its members, so changes made because of them can be traced back to
+// it, and kept for the node's status.
+func (gp *groupParser) parse(groupKey string, modifyIndex uint64, j map[string]interface{}) (*groups.Definition, error) {
+	def, err := parseGroupDefinition(gp.uc, groupKey, j)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range def.Members {
+		m.ModifyIndex = modifyIndex
+	}
+	gp.indices[groupKey] = modifyIndex
+	gp.noteChange(groups.ApplyValidity(def.Members, gp.now))
+	return def, nil
+}
+
+// noteChange keeps track of the earliest upcoming time something needs to
+// be done, like a membership starting or ending or a scheduled disable.
+func (gp *groupParser) noteChange(next time.Time) {
+	if !next.IsZero() && (gp.nextChange.IsZero() || next.Before(gp.nextChange)) {
+		gp.nextChange = next
+	}
+}
+
+// fetch looks up a group definition in consul so included groups can be
+// expanded. It satisfies groups.FetchFunc.
+func (gp *groupParser) fetch(key string) (*groups.Definition, error) {
+	kval, _, err := gp.c.KV().Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if kval == nil {
+		err := fmt.Errorf("included group '%s' not found", key)
+		return nil, err
+	}
+	j := make(map[string]interface{})
+	if err = json.Unmarshal(kval.Value, &j); err != nil {
+		return nil, fmt.Errorf("could not parse included group '%s': %s", key, err.Error())
+	}
+	return gp.parse(key, kval.ModifyIndex, j)
+}
+
+// parseGroupDefinition turns a decoded group definition into a
+// groups.Definition, filling in any members picked out by the group's
+// selector.
+func parseGroupDefinition(uc *users.UserExtDataClient, groupKey string, j map[string]interface{}) (*groups.Definition, error) {
+	var commonGroups []string
+	if cg, ok := j["common_groups"].([]interface{}); ok && len(cg) > 0 {
+		commonGroups = make([]string, len(cg))
+		for i, gg := range cg {
+			if c, cok := gg.(string); cok {
+				commonGroups[i] = c
+			}
+		}
+	}
+	defaults, err := convertGroupDefaults(j)
+	if err != nil {
+		return nil, fmt.Errorf("bad defaults in group %s: %s", groupKey, err.Error())
+	}
+	members, _ := j["members"].([]interface{})
+	convUsers, err := convertUsersInterfaceSlice(members, commonGroups, groupKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range convUsers {
+		m.Defaults = defaults
+	}
+	if sel, ok := j["selector"].(map[string]interface{}); ok && len(sel) > 0 {
+		selector, err := convertSelector(sel)
+		if err != nil {
+			return nil, err
+		}
+		selected, err := uc.MatchSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("selector %s in %s matched %d users", selector, groupKey, len(selected))
+		convUsers = groups.AddSelectedMembers(convUsers, selected, commonGroups, groupKey, defaults)
+	}
+
+	def := &groups.Definition{Key: groupKey, Members: convUsers, CommonGroups: commonGroups, Defaults: defaults}
+
+	if inc, ok := j["include"].([]interface{}); ok {
+		for _, i := range inc {
+			ik, iok := i.(string)
+			if !iok {
+				err := fmt.Errorf("included group in %s was supposed to be a string, but was actually %T", groupKey, i)
+				return nil, err
+			}
+			def.Include = append(def.Include, ik)
+		}
+	}
+
+	return def, nil
 }
 
-func convertUsersInterfaceSlice(u []interface{}, commonGroups []string) ([]*groups.Member, error) {
+func convertUsersInterfaceSlice(u []interface{}, commonGroups []string, groupKey string) ([]*groups.Member, error) {
 	l := len(u)
 	users := make([]*groups.Member, l)
 	for i, v := range u {
@@ -174,8 +460,158 @@ func convertUsersInterfaceSlice(u []interface{}, commonGroups []string) ([]*grou
 		m := new(groups.Member)
 		m.Username = s["username"].(string)
 		m.Status = s["status"].(string)
+		for _, f := range []struct {
+			key string
+			dst **time.Time
+		}{{"valid_from", &m.ValidFrom}, {"valid_until", &m.ValidUntil}} {
+			v, ok := s[f.key]
+			if !ok {
+				continue
+			}
+			ts, tok := v.(string)
+			if !tok {
+				err := fmt.Errorf("%s for %s was supposed to be a string, but was actually %T", f.key, m.Username, v)
+				return nil, err
+			}
+			t, err := time.Parse(time.RFC3339, ts)
+			if err != nil {
+				err = fmt.Errorf("could not parse %s for %s: %s", f.key, m.Username, err.Error())
+				return nil, err
+			}
+			*f.dst = &t
+		}
 		m.CommonGroups = commonGroups
+		m.GroupKey = groupKey
 		users[i] = m
 	}
 	return users, nil
 }
+
+// convertGroupDefaults pulls the default shell, primary group, home directory
+// base, whether to create home directories, and the disable policy for the
+// group's members out of the group definition. If the group sets none of
+// them, nil is returned.
+func convertGroupDefaults(j map[string]interface{}) (*groups.Defaults, error) {
+	d := new(groups.Defaults)
+	var set bool
+
+	strFields := []struct {
+		key string
+		dst *string
+	}{
+		{"default_shell", &d.Shell},
+		{"default_primary_group", &d.PrimaryGroup},
+		{"home_base", &d.HomeBase},
+	}
+	for _, f := range strFields {
+		v, ok := j[f.key]
+		if !ok {
+			continue
+		}
+		sv, sok := v.(string)
+		if !sok {
+			err := fmt.Errorf("'%s' was supposed to be a string, but was actually %T", f.key, v)
+			return nil, err
+		}
+		*f.dst = sv
+		set = true
+	}
+
+	if v, ok := j["create_home"]; ok {
+		b, bok := v.(bool)
+		if !bok {
+			err := fmt.Errorf("'create_home' was supposed to be a boolean, but was actually %T", v)
+			return nil, err
+		}
+		d.CreateHome = &b
+		set = true
+	}
+
+	if v, ok := j["disable_after_inactive_days"]; ok {
+		f, fok := v.(float64)
+		if !fok {
+			err := fmt.Errorf("'disable_after_inactive_days' was supposed to be a number, but was actually %T", v)
+			return nil, err
+		}
+		days := int(f)
+		d.InactiveDays = &days
+		set = true
+	}
+
+	if v, ok := j["disable_policy"]; ok {
+		dp, err := convertDisablePolicy(v)
+		if err != nil {
+			return nil, err
+		}
+		d.Disable = dp
+		set = true
+	}
+
+	if !set {
+		return nil, nil
+	}
+	return d, nil
+}
+
+func convertDisablePolicy(v interface{}) (*groups.DisablePolicy, error) {
+	if _, ok := v.(map[string]interface{}); !ok {
+		err := fmt.Errorf("'disable_policy' was supposed to be a hash, but was actually %T", v)
+		return nil, err
+	}
+	// Easiest to just round trip it through JSON.
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dp := new(groups.DisablePolicy)
+	if err = json.Unmarshal(raw, dp); err != nil {
+		return nil, fmt.Errorf("could not parse 'disable_policy': %s", err.Error())
+	}
+	return dp, nil
+}
+
+func convertSelector(s map[string]interface{}) (groups.Selector, error) {
+	sel := make(groups.Selector, len(s))
+	for k, v := range s {
+		sv, ok := v.(string)
+		if !ok {
+			err := fmt.Errorf("selector value for '%s' was supposed to be a string, but was actually %T", k, v)
+			return nil, err
+		}
+		sel[k] = sv
+	}
+	return sel, nil
+}
+
+// blastRadiusOverridden checks if a run that would disable or delete too many
+// users should go ahead anyway, either because of the command line flag or
+// because the override key is present in consul. The override key is shared
+// by every node, so rather than removing it each node remembers the
+// ModifyIndex of the key when it used it in the user state, and only lets one
+// run through for each version of the key.
+func blastRadiusOverridden(c *consul.Client, us *state.UserState) bool {
+	if config.Config.OverrideLimit {
+		logger.Warningf("blast radius limit overridden on the command line")
+		return true
+	}
+	kv := c.KV()
+	kval, _, err := kv.Get(config.Config.OverrideKey, nil)
+	if err != nil {
+		logger.Errorf("could not check the blast radius override key %s: %s", config.Config.OverrideKey, err.Error())
+		return false
+	}
+	if kval == nil {
+		return false
+	}
+	if us == nil {
+		logger.Warningf("blast radius limit overridden by the %s key in consul; with no user state file to remember that it's been used, it will keep overriding the limit until it's removed", config.Config.OverrideKey)
+		return true
+	}
+	if us.OverrideUsed(kval.ModifyIndex) {
+		logger.Warningf("the blast radius override key %s has already been used on this node; set it again to override the limit again", config.Config.OverrideKey)
+		return false
+	}
+	us.UseOverride(kval.ModifyIndex)
+	logger.Warningf("blast radius limit overridden by the %s key in consul (index %d)", config.Config.OverrideKey, kval.ModifyIndex)
+	return true
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package audit keeps an append-only log of every change spqr makes to the
+// accounts on a machine, one JSON object per line. Each line includes the hash
+// of the line before it, so lines that are changed, removed, or reordered
+// after the fact can be spotted with Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/spqr/internal/command"
+	"github.com/tideland/golib/logger"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Change is the kind of change an audit log entry records.
+type Change string
+
+const (
+	Create          Change = "create"
+	Delete          Change = "delete"
+	Disable         Change = "disable"
+	Reenable        Change = "reenable"
+	KeyAdded        Change = "key_added"
+	KeyRemoved      Change = "key_removed"
+	Groups          Change = "groups"
+	PrimaryGroup    Change = "primary_group"
+	Shell           Change = "shell"
+	Name            Change = "name"
+	ProcessesKilled Change = "processes_killed"
+	Command         Change = "command"
+)
+
+const (
+	logPerm    = 0600
+	logDirPerm = 0750
+)
+
+// Source is the consul key that caused a change, and its ModifyIndex at the
+// time.
+type Source struct {
+	Key         string `json:"consul_key,omitempty"`
+	ModifyIndex uint64 `json:"modify_index,omitempty"`
+}
+
+// Entry is one line in the audit log. Only the fields that make sense for the
+// kind of change are filled in.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	RunID  string    `json:"run_id"`
+	Host   string    `json:"host"`
+	User   string    `json:"user"`
+	Change Change    `json:"change"`
+	Source
+	Uid string `json:"uid,omitempty"`
+	// Fingerprint is the SHA256 fingerprint of an ssh key that was added
+	// or removed.
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Added       []string `json:"added,omitempty"`
+	Removed     []string `json:"removed,omitempty"`
+	From        string   `json:"from,omitempty"`
+	To          string   `json:"to,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
+	// Archive is where a deleted user's home directory was archived.
+	Archive string `json:"archive,omitempty"`
+	Pids    []int  `json:"pids,omitempty"`
+	// Command is an outside command that was run to make a change.
+	Command  *command.Result `json:"command,omitempty"`
+	PrevHash string          `json:"prev_hash"`
+	Hash     string          `json:"hash,omitempty"`
+}
+
+// Log is an open audit log that entries are appended to.
+type Log struct {
+	path  string
+	runID string
+	host  string
+	f     *os.File
+	last  string
+	mu    sync.Mutex
+}
+
+// Open opens the audit log at the given path for appending, creating it and
+// its directory if they don't exist yet. Every entry written through it is
+// marked with runID.
+func Open(path string, runID string) (*Log, error) {
+	last, _, err := readChain(path, false)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), logDirPerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, logPerm)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &Log{path: path, runID: runID, host: host, f: f, last: last}, nil
+}
+
+// NewRunID makes up a new random ID for a run of spqr.
+func NewRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Record appends an entry to the log, filling in the time, run ID, host, and
+// hashes. A nil Log records nothing, so callers don't need to check whether
+// there's an audit log at all. Failing to write to the audit log is logged,
+// but doesn't stop the change from happening.
+func (l *Log) Record(e *Entry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Time = time.Now().UTC()
+	e.RunID = l.runID
+	e.Host = l.host
+	e.PrevHash = l.last
+	e.Hash = ""
+
+	line, hash, err := seal(e)
+	if err != nil {
+		logger.Errorf("could not write %s of %s to the audit log: %s", e.Change, e.User, err.Error())
+		return
+	}
+	if _, err = l.f.Write(line); err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		logger.Errorf("could not write %s of %s to the audit log %s: %s", e.Change, e.User, l.path, err.Error())
+		return
+	}
+	e.Hash = hash
+	l.last = hash
+}
+
+// CommandRecorder returns a command.Recorder that writes every command that's
+// run into the log.
+func (l *Log) CommandRecorder() command.Recorder {
+	return commandRecorder{l}
+}
+
+type commandRecorder struct {
+	log *Log
+}
+
+func (c commandRecorder) Record(r *command.Result) {
+	c.log.Record(&Entry{Change: Command, Command: r})
+}
+
+// Close closes the audit log.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Verify checks the hash chain of the audit log at the given path, returning
+// the number of entries in it. An error is returned at the first entry that's
+// been tampered with.
+func Verify(path string) (int, error) {
+	_, n, err := readChain(path, true)
+	return n, err
+}
+
+// seal hashes the entry and returns it as a line for the audit log, with the
+// hash added to the end. The hash covers exactly the bytes of the line before
+// the hash field, so it can be checked without decoding and re-encoding the
+// entry.
+func seal(e *Entry) ([]byte, string, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := hashOf(body)
+	line := make([]byte, 0, len(body)+len(hash)+12)
+	line = append(line, body[:len(body)-1]...)
+	line = append(line, fmt.Sprintf(`,"hash":"%s"}`, hash)...)
+	line = append(line, '\n')
+	return line, hash, nil
+}
+
+func hashOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// readChain reads through an audit log, returning the hash of the last entry
+// and how many entries there are. If check is set every entry's hash and link
+// to the entry before it are checked too.
+func readChain(path string, check bool) (string, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	var last string
+	var n int
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return "", n, err
+		}
+		line = bytes.TrimRight(line, "\n")
+		if len(line) == 0 {
+			continue
+		}
+		n++
+		body, hash, err := unseal(line)
+		if err != nil {
+			return "", n, fmt.Errorf("entry %d in %s: %s", n, path, err.Error())
+		}
+		if check {
+			if h := hashOf(body); h != hash {
+				return "", n, fmt.Errorf("entry %d in %s has been altered: its hash should be %s, not %s", n, path, h, hash)
+			}
+			var e Entry
+			if err = json.Unmarshal(body, &e); err != nil {
+				return "", n, fmt.Errorf("entry %d in %s: %s", n, path, err.Error())
+			}
+			if e.PrevHash != last {
+				return "", n, fmt.Errorf("entry %d in %s doesn't follow the entry before it: it says the previous hash was '%s', but it was '%s'", n, path, e.PrevHash, last)
+			}
+		}
+		last = hash
+	}
+	return last, n, nil
+}
+
+// unseal splits a line from the audit log into the entry as it was hashed and
+// its hash.
+func unseal(line []byte) ([]byte, string, error) {
+	const hashField = `,"hash":"`
+	i := bytes.LastIndex(line, []byte(hashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", fmt.Errorf("no hash found")
+	}
+	hash := string(line[i+len(hashField) : len(line)-2])
+	body := make([]byte, 0, i+1)
+	body = append(body, line[:i]...)
+	body = append(body, '}')
+	return body, hash, nil
+}
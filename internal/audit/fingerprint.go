@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+)
+
+// KeyFingerprint returns the SHA256 fingerprint of the key in a line from an
+// authorized_keys file, in the same form ssh-keygen -l gives it. Any options
+// at the start of the line are skipped. If there's no key to be found in the
+// line, the line itself is hashed instead and marked as such, so the same
+// line always gets the same fingerprint.
+func KeyFingerprint(line string) string {
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		blob, err := base64.StdEncoding.DecodeString(fields[i+1])
+		if err != nil || !blobHasType(blob, fields[i]) {
+			continue
+		}
+		sum := sha256.Sum256(blob)
+		return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+	}
+	sum := sha256.Sum256([]byte(line))
+	return "line-SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// blobHasType checks that a decoded ssh public key starts with the key type
+// it's supposed to be.
+func blobHasType(blob []byte, keyType string) bool {
+	if len(blob) < 4 {
+		return false
+	}
+	n := binary.BigEndian.Uint32(blob)
+	return uint64(n) == uint64(len(keyType)) && len(blob) >= 4+len(keyType) && string(blob[4:4+len(keyType)]) == keyType
+}
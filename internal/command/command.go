@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package command runs the outside programs spqr uses to change the system,
+// like useradd and passwd, and keeps a record of every one of them: what was
+// run, how long it took, how it exited, and what it had to say.
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/tideland/golib/logger"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long a command may run before it's killed, unless
+// configured otherwise.
+const DefaultTimeout = 60 * time.Second
+
+// maxOutput is the most of a command's stdout or stderr that's kept in its
+// result. Nothing spqr runs should have much to say.
+const maxOutput = 4096
+
+// Result is the record of a command that was run.
+type Result struct {
+	Command  string        `json:"command"`
+	Args     []string      `json:"args"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	ExitCode int           `json:"exit_code"`
+	TimedOut bool          `json:"timed_out,omitempty"`
+	Stdout   string        `json:"stdout,omitempty"`
+	Stderr   string        `json:"stderr,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Recorder is given the result of every command that's run.
+type Recorder interface {
+	Record(r *Result)
+}
+
+var (
+	mu        sync.Mutex
+	timeout   = DefaultTimeout
+	recorders []Recorder
+)
+
+// SetTimeout sets how long commands may run before they're killed. A timeout
+// of zero or less sets it back to the default.
+func SetTimeout(d time.Duration) {
+	if d <= 0 {
+		d = DefaultTimeout
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	timeout = d
+}
+
+// AddRecorder has the results of commands run from now on given to r as well.
+func AddRecorder(r Recorder) {
+	mu.Lock()
+	defer mu.Unlock()
+	recorders = append(recorders, r)
+}
+
+// RemoveRecorder stops giving the results of commands to r.
+func RemoveRecorder(r Recorder) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, rec := range recorders {
+		if rec == r {
+			recorders = append(recorders[:i], recorders[i+1:]...)
+			return
+		}
+	}
+}
+
+// Run runs the named command with the given arguments, killing it if it runs
+// for longer than the timeout. The result is logged and handed to the
+// recorders whether the command worked or not. If the command fails the
+// returned error includes whatever it wrote to stderr.
+func Run(name string, args ...string) (*Result, error) {
+	mu.Lock()
+	t := timeout
+	mu.Unlock()
+
+	r := &Result{Command: name, Args: args, Started: time.Now(), ExitCode: -1}
+
+	cmdPath, err := exec.LookPath(name)
+	if err != nil {
+		r.Error = err.Error()
+		record(r)
+		return r, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cmdPath, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	r.Duration = time.Since(r.Started)
+	if cmd.ProcessState != nil {
+		r.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	r.Stdout = truncate(stdout.String())
+	r.Stderr = truncate(stderr.String())
+	if ctx.Err() == context.DeadlineExceeded {
+		r.TimedOut = true
+		err = fmt.Errorf("timed out after %s", t)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s :: %s", err.Error(), stderr.String())
+		r.Error = err.Error()
+	}
+
+	record(r)
+	return r, err
+}
+
+func record(r *Result) {
+	if r.Error != "" {
+		logger.Warningf("Ran %s", r)
+	} else {
+		logger.Infof("Ran %s", r)
+	}
+	if r.Stdout != "" {
+		logger.Debugf("stdout from %s: %s", r.Command, r.Stdout)
+	}
+	if r.Stderr != "" {
+		logger.Debugf("stderr from %s: %s", r.Command, r.Stderr)
+	}
+
+	mu.Lock()
+	recs := make([]Recorder, len(recorders))
+	copy(recs, recorders)
+	mu.Unlock()
+	for _, rec := range recs {
+		rec.Record(r)
+	}
+}
+
+func truncate(s string) string {
+	if len(s) <= maxOutput {
+		return s
+	}
+	return s[:maxOutput] + "... (truncated)"
+}
+
+// CommandLine returns the command and its arguments as one string. Arguments
+// that are empty or have spaces in them are quoted.
+func (r *Result) CommandLine() string {
+	words := make([]string, 0, len(r.Args)+1)
+	words = append(words, r.Command)
+	for _, a := range r.Args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"") {
+			a = strconv.Quote(a)
+		}
+		words = append(words, a)
+	}
+	return strings.Join(words, " ")
+}
+
+func (r *Result) String() string {
+	s := fmt.Sprintf("'%s': exit code %d after %s", r.CommandLine(), r.ExitCode, r.Duration.Round(time.Millisecond))
+	if r.TimedOut {
+		s += " (timed out)"
+	}
+	return s
+}
+
+// Report collects the results of the commands run during one run of spqr.
+type Report struct {
+	Started  time.Time
+	Commands []*Result
+	mu       sync.Mutex
+}
+
+// NewReport makes a new, empty report. It needs to be added with AddRecorder
+// for commands to be recorded in it.
+func NewReport() *Report {
+	return &Report{Started: time.Now()}
+}
+
+// Record adds a command's result to the report.
+func (rp *Report) Record(r *Result) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.Commands = append(rp.Commands, r)
+}
+
+// Failed returns the results of the commands that failed.
+func (rp *Report) Failed() []*Result {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	var failed []*Result
+	for _, r := range rp.Commands {
+		if r.Error != "" {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Total returns how many commands are in the report, and how long they took
+// in all.
+func (rp *Report) Total() (int, time.Duration) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	var total time.Duration
+	for _, r := range rp.Commands {
+		total += r.Duration
+	}
+	return len(rp.Commands), total
+}
+
+// Summary sums up the commands in the report in a line.
+func (rp *Report) Summary() string {
+	failed := len(rp.Failed())
+	ran, total := rp.Total()
+	return fmt.Sprintf("ran %d commands taking %s in all, %d of which failed", ran, total.Round(time.Millisecond), failed)
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fleet holds what the nodes running spqr publish about themselves to
+// consul, and reports on it alongside the group and user definitions: who has
+// access where, and which nodes haven't caught up with what they're supposed
+// to look like.
+package fleet
+
+import (
+	"github.com/ctdk/spqr/internal/command"
+	"github.com/ctdk/spqr/internal/groups"
+	"github.com/ctdk/spqr/internal/users"
+	"sort"
+	"time"
+)
+
+// NodeStatus is how the last run on a node went, as published to
+// <spqr key prefix>/nodes/<node name>/status.
+type NodeStatus struct {
+	Node         string            `json:"node"`
+	Version      string            `json:"spqr_version"`
+	GitHash      string            `json:"git_hash"`
+	RunID        string            `json:"run_id"`
+	LastRun      time.Time         `json:"last_run"`
+	Duration     float64           `json:"duration_seconds"`
+	Succeeded    bool              `json:"succeeded"`
+	Errors       []string          `json:"errors,omitempty"`
+	GroupIndices map[string]uint64 `json:"group_indices"`
+	Users        users.Results     `json:"users"`
+	Commands     *CommandSummary   `json:"commands,omitempty"`
+}
+
+// CommandSummary sums up the outside commands run during a node's last run,
+// with the full results of any that failed.
+type CommandSummary struct {
+	Ran      int               `json:"ran"`
+	Duration float64           `json:"duration_seconds"`
+	Failed   []*command.Result `json:"failed,omitempty"`
+}
+
+// NodeInventory is what the accounts spqr manages actually look like on a
+// node, as published to <spqr key prefix>/nodes/<node name>/inventory.
+type NodeInventory struct {
+	Node    string                  `json:"node"`
+	RunID   string                  `json:"run_id"`
+	Updated time.Time               `json:"updated"`
+	Users   []*users.InventoryEntry `json:"users"`
+}
+
+// Node is everything a node has published about itself. Either may be nil if
+// the node hasn't published it.
+type Node struct {
+	Name      string
+	Status    *NodeStatus
+	Inventory *NodeInventory
+}
+
+// Group is a group definition as it is in consul now, with its included
+// groups expanded.
+type Group struct {
+	Key         string
+	ModifyIndex uint64
+	Include     []string
+	Members     []*groups.Member
+}
+
+// Fleet is the group and user definitions in consul, along with what the
+// nodes have published about themselves.
+type Fleet struct {
+	Groups      map[string]*Group
+	Users       map[string]*users.UserInfo
+	Nodes       map[string]*Node
+	MergePolicy groups.MergePolicy
+}
+
+// New makes a new, empty Fleet.
+func New(policy groups.MergePolicy) *Fleet {
+	return &Fleet{
+		Groups:      make(map[string]*Group),
+		Users:       make(map[string]*users.UserInfo),
+		Nodes:       make(map[string]*Node),
+		MergePolicy: policy,
+	}
+}
+
+// Node returns the named node, adding it if it isn't there yet.
+func (f *Fleet) Node(name string) *Node {
+	n, ok := f.Nodes[name]
+	if !ok {
+		n = &Node{Name: name}
+		f.Nodes[name] = n
+	}
+	return n
+}
+
+func (f *Fleet) nodeNames() []string {
+	names := make([]string, 0, len(f.Nodes))
+	for name := range f.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// What a user's account should be, or is, like on a node.
+const (
+	StateEnabled  = "enabled"
+	StateDisabled = "disabled"
+	StateDeleted  = "deleted"
+	StateAbsent   = "absent"
+	StateUnknown  = "unknown"
+	// StateUndefined is for users who are in a group, but have no user
+	// definition, so spqr leaves them alone.
+	StateUndefined = "undefined"
+)
+
+// wanted is what a user's account should be like on a node.
+type wanted struct {
+	state        string
+	via          []string
+	fingerprints []string
+}
+
+// desired works out what the users on a node should look like, from the
+// groups the node applied in its last run as they are in consul now. Groups
+// that are only there because another of the node's groups includes them
+// aren't counted twice.
+func (f *Fleet) desired(n *Node) map[string]*wanted {
+	want := make(map[string]*wanted)
+	if n.Status == nil {
+		return want
+	}
+
+	included := make(map[string]bool)
+	for key := range n.Status.GroupIndices {
+		if g, ok := f.Groups[key]; ok {
+			for _, i := range g.Include {
+				included[i] = true
+			}
+		}
+	}
+	var keys []string
+	for key := range n.Status.GroupIndices {
+		if _, ok := f.Groups[key]; ok && !included[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var lists [][]*groups.Member
+	via := make(map[string][]string)
+	for _, key := range keys {
+		g := f.Groups[key]
+		lists = append(lists, g.Members)
+		for _, m := range g.Members {
+			if l := via[m.Username]; len(l) == 0 || l[len(l)-1] != key {
+				via[m.Username] = append(l, key)
+			}
+		}
+	}
+	if len(lists) == 0 {
+		return want
+	}
+	merged, _, err := groups.RemoveDupeUsers(lists, f.MergePolicy)
+	if err != nil {
+		return want
+	}
+
+	for _, m := range merged {
+		w := &wanted{state: StateEnabled, via: via[m.Username]}
+		def, ok := f.Users[m.Username]
+		switch {
+		case !ok:
+			w.state = StateUndefined
+		case def.Action == users.Delete:
+			w.state = StateDeleted
+		case m.Status == groups.Disabled, def.Action == users.Disable, def.Action == users.Revoke:
+			w.state = StateDisabled
+		}
+		if ok {
+			w.fingerprints = fingerprints(def.AuthorizedKeys)
+		}
+		want[m.Username] = w
+	}
+	return want
+}
+
+// actual finds a user in a node's inventory. It returns the state of their
+// account and their inventory entry, if they have one.
+func (n *Node) actual(username string) (string, *users.InventoryEntry) {
+	if n.Inventory == nil {
+		return StateUnknown, nil
+	}
+	for _, e := range n.Inventory.Users {
+		if e.Username != username {
+			continue
+		}
+		if e.Enabled {
+			return StateEnabled, e
+		}
+		return StateDisabled, e
+	}
+	return StateAbsent, nil
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fleet
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// The formats reports can be written out in.
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+)
+
+// Tabular is a report that can be written out as a table or CSV, as well as
+// JSON.
+type Tabular interface {
+	Columns() []string
+	Rows() [][]string
+}
+
+// Write writes a report out in the given format. The JSON format is the
+// report itself, which keeps lists as lists; the table and CSV formats put
+// spaces between the items in lists instead.
+func Write(w io.Writer, format string, t Tabular) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(t.Columns()); err != nil {
+			return err
+		}
+		return cw.WriteAll(t.Rows())
+	case FormatTable, "":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(t.Columns(), "\t")))
+		for _, row := range t.Rows() {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown report format '%s'", format)
+	}
+}
@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fleet
+
+import (
+	"fmt"
+	"github.com/ctdk/spqr/internal/audit"
+	"github.com/ctdk/spqr/internal/users"
+	"github.com/ctdk/spqr/internal/util"
+	"sort"
+	"strings"
+)
+
+// UserAccessEntry is what a user's access to a node should be, and what it
+// actually is.
+type UserAccessEntry struct {
+	Node            string   `json:"node"`
+	Username        string   `json:"username"`
+	Desired         string   `json:"desired"`
+	Actual          string   `json:"actual"`
+	Via             []string `json:"via"`
+	Uid             string   `json:"uid,omitempty"`
+	Shell           string   `json:"shell,omitempty"`
+	Groups          []string `json:"groups,omitempty"`
+	KeyFingerprints []string `json:"key_fingerprints,omitempty"`
+}
+
+// UserAccess is where a user has, or should have, access.
+type UserAccess []*UserAccessEntry
+
+// UserAccess reports on every node the user should have an account on, or
+// does.
+func (f *Fleet) UserAccess(username string) UserAccess {
+	report := UserAccess{}
+	for _, name := range f.nodeNames() {
+		n := f.Nodes[name]
+		e := &UserAccessEntry{Node: name, Username: username, Desired: StateAbsent}
+		if n.Status == nil {
+			e.Desired = StateUnknown
+		} else if w, ok := f.desired(n)[username]; ok {
+			e.Desired = w.state
+			e.Via = w.via
+		}
+		var inv *users.InventoryEntry
+		e.Actual, inv = n.actual(username)
+		if inv != nil {
+			e.Uid = inv.Uid
+			e.Shell = inv.Shell
+			e.Groups = inv.Groups
+			e.KeyFingerprints = inv.KeyFingerprints
+		}
+		if e.Desired == StateAbsent && e.Actual == StateAbsent {
+			continue
+		}
+		report = append(report, e)
+	}
+	return report
+}
+
+func (r UserAccess) Columns() []string {
+	return []string{"node", "username", "desired", "actual", "via", "uid", "shell", "groups", "key_fingerprints"}
+}
+
+func (r UserAccess) Rows() [][]string {
+	rows := make([][]string, len(r))
+	for i, e := range r {
+		rows[i] = []string{e.Node, e.Username, e.Desired, e.Actual, join(e.Via), e.Uid, e.Shell, join(e.Groups), join(e.KeyFingerprints)}
+	}
+	return rows
+}
+
+// LoginEntry is a user who can log into a node.
+type LoginEntry struct {
+	Node            string   `json:"node"`
+	Username        string   `json:"username"`
+	Uid             string   `json:"uid"`
+	Shell           string   `json:"shell"`
+	Groups          []string `json:"groups"`
+	KeyFingerprints []string `json:"key_fingerprints"`
+}
+
+// Logins are the users who can log into a set of nodes.
+type Logins []*LoginEntry
+
+// GroupLogins reports on who can actually log into the nodes that applied the
+// group in their last run, either directly or because another of their
+// groups includes it. It also returns the nodes that applied the group but
+// haven't published an inventory, since who can log into them isn't known.
+func (f *Fleet) GroupLogins(groupKey string) (Logins, []string) {
+	report := Logins{}
+	var unknown []string
+	for _, name := range f.nodeNames() {
+		n := f.Nodes[name]
+		if n.Status == nil {
+			continue
+		}
+		if _, ok := n.Status.GroupIndices[groupKey]; !ok {
+			continue
+		}
+		if n.Inventory == nil {
+			unknown = append(unknown, name)
+			continue
+		}
+		for _, e := range n.Inventory.Users {
+			if !e.Enabled {
+				continue
+			}
+			report = append(report, &LoginEntry{Node: name, Username: e.Username, Uid: e.Uid, Shell: e.Shell, Groups: e.Groups, KeyFingerprints: e.KeyFingerprints})
+		}
+	}
+	return report, unknown
+}
+
+func (r Logins) Columns() []string {
+	return []string{"node", "username", "uid", "shell", "groups", "key_fingerprints"}
+}
+
+func (r Logins) Rows() [][]string {
+	rows := make([][]string, len(r))
+	for i, e := range r {
+		rows[i] = []string{e.Node, e.Username, e.Uid, e.Shell, join(e.Groups), join(e.KeyFingerprints)}
+	}
+	return rows
+}
+
+// DriftEntry is one way a node differs from what it's supposed to look like.
+// Username is empty for problems with the node as a whole.
+type DriftEntry struct {
+	Node     string `json:"node"`
+	Username string `json:"username,omitempty"`
+	Problem  string `json:"problem"`
+}
+
+// Drift is every way the nodes differ from what they're supposed to look
+// like.
+type Drift []*DriftEntry
+
+// Drift compares each node's inventory with what it should look like going
+// by the groups it applied in its last run, as they are in consul now. It also
+// reports nodes whose last run failed, and nodes that haven't applied the
+// latest version of one of their groups.
+func (f *Fleet) Drift() Drift {
+	report := Drift{}
+	for _, name := range f.nodeNames() {
+		n := f.Nodes[name]
+		add := func(username string, format string, args ...interface{}) {
+			report = append(report, &DriftEntry{Node: name, Username: username, Problem: fmt.Sprintf(format, args...)})
+		}
+
+		if n.Status == nil {
+			add("", "no status published")
+		} else {
+			if !n.Status.Succeeded {
+				add("", "last run at %s failed: %s", n.Status.LastRun.Format("2006-01-02 15:04:05 MST"), strings.Join(n.Status.Errors, "; "))
+			}
+			for _, key := range sortedKeys(n.Status.GroupIndices) {
+				applied := n.Status.GroupIndices[key]
+				g, ok := f.Groups[key]
+				switch {
+				case !ok:
+					add("", "group %s no longer exists", key)
+				case g.ModifyIndex > applied:
+					add("", "hasn't applied the latest %s (applied index %d, current index %d)", key, applied, g.ModifyIndex)
+				}
+			}
+		}
+		if n.Inventory == nil {
+			add("", "no inventory published")
+			continue
+		}
+		if n.Status == nil {
+			continue
+		}
+
+		want := f.desired(n)
+		for _, username := range sortedWanted(want) {
+			w := want[username]
+			actual, inv := n.actual(username)
+			switch w.state {
+			case StateEnabled:
+				switch actual {
+				case StateAbsent:
+					add(username, "should be enabled, but has no account")
+				case StateDisabled:
+					add(username, "should be enabled, but is disabled (%s)", strings.Join(inv.DisabledSigns, "; "))
+				default:
+					missing, extra := util.SliceDiff(inv.KeyFingerprints, w.fingerprints)
+					if len(missing) > 0 || len(extra) > 0 {
+						add(username, "ssh keys differ: %d missing, %d extra", len(missing), len(extra))
+					}
+				}
+			case StateDisabled:
+				if actual == StateEnabled {
+					add(username, "should be disabled, but is enabled")
+				}
+			case StateDeleted:
+				if actual != StateAbsent {
+					add(username, "should be deleted, but still has an account")
+				}
+			}
+		}
+		for _, e := range n.Inventory.Users {
+			if _, ok := want[e.Username]; !ok && e.Enabled {
+				add(e.Username, "is enabled, but isn't in any of the node's groups")
+			}
+		}
+	}
+	return report
+}
+
+func (r Drift) Columns() []string {
+	return []string{"node", "username", "problem"}
+}
+
+func (r Drift) Rows() [][]string {
+	rows := make([][]string, len(r))
+	for i, e := range r {
+		rows[i] = []string{e.Node, e.Username, e.Problem}
+	}
+	return rows
+}
+
+// fingerprints gets the fingerprints of the keys in the lines of an
+// authorized_keys file, skipping blank lines and comments.
+func fingerprints(keys []string) []string {
+	fps := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if k = strings.TrimSpace(k); k == "" || strings.HasPrefix(k, "#") {
+			continue
+		}
+		fps = append(fps, audit.KeyFingerprint(k))
+	}
+	return fps
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedWanted(m map[string]*wanted) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func join(s []string) string {
+	return strings.Join(s, " ")
+}
@@ -23,13 +23,69 @@ import (
 	"fmt"
 	"github.com/ctdk/spqr/internal/util"
 	"github.com/tideland/golib/logger"
+	"reflect"
 	"sort"
+	"strings"
+	"time"
 )
 
 type Member struct {
-	Username string `json:"username"`
-	Status   string `json:"status"`
-	CommonGroups []string `json:"common_groups"`
+	Username     string    `json:"username"`
+	Status       string    `json:"status"`
+	CommonGroups []string  `json:"common_groups"`
+	GroupKey     string    `json:"-"`
+	ModifyIndex  uint64    `json:"-"`
+	Via          []string  `json:"-"`
+	Defaults     *Defaults `json:"-"`
+	// ValidFrom and ValidUntil are nil when that end of the member's
+	// validity window is left open.
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+// Active reports whether t falls within the member's validity window. The
+// window starts at ValidFrom and ends just before ValidUntil, and either end
+// may be left open by leaving it nil.
+func (m *Member) Active(t time.Time) bool {
+	if m.ValidFrom != nil && t.Before(*m.ValidFrom) {
+		return false
+	}
+	if m.ValidUntil != nil && !t.Before(*m.ValidUntil) {
+		return false
+	}
+	return true
+}
+
+// ApplyValidity disables any members whose validity window doesn't include
+// now, as if they'd been marked disabled in the group. It returns the next
+// time after now that any of the members' windows opens or closes, or the
+// zero time if none will.
+func ApplyValidity(members []*Member, now time.Time) time.Time {
+	var next time.Time
+	soonest := func(t *time.Time) {
+		if t != nil && t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = *t
+		}
+	}
+	for _, m := range members {
+		if m.ValidFrom == nil && m.ValidUntil == nil {
+			continue
+		}
+		soonest(m.ValidFrom)
+		soonest(m.ValidUntil)
+		if m.Status == Enabled && !m.Active(now) {
+			logger.Infof("%s is outside their membership window in %s (valid from '%s' until '%s'), treating them as disabled", m.Username, m.GroupKey, fmtWindowTime(m.ValidFrom), fmtWindowTime(m.ValidUntil))
+			m.Status = Disabled
+		}
+	}
+	return next
+}
+
+func fmtWindowTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
 }
 
 const (
@@ -37,91 +93,551 @@ const (
 	Disabled = "disabled"
 )
 
-type GroupMembers []*Member
+// Definition is a single spqr group definition.
+type Definition struct {
+	Key          string
+	Members      []*Member
+	CommonGroups []string
+	Include      []string
+	Defaults     *Defaults
+}
 
-func (gm GroupMembers) Len() int           { return len(gm) }
-func (gm GroupMembers) Swap(i, j int)      { gm[i], gm[j] = gm[j], gm[i] }
-func (gm GroupMembers) Less(i, j int) bool { return gm[i].Username < gm[j].Username }
+// Defaults are account settings a group provides for its members, used when
+// the member's user definition leaves them out.
+type Defaults struct {
+	Shell        string
+	PrimaryGroup string
+	HomeBase     string
+	CreateHome   *bool
+	Disable      *DisablePolicy
+	// InactiveDays, if more than zero, disables members who haven't
+	// logged in for that many days.
+	InactiveDays *int
+}
 
-func RemoveDupeUsers(groups [][]*Member) ([]*Member, error) {
-	var list []*Member
+// DefaultKillGraceSeconds is how long a disabled user's processes are given
+// to exit after SIGTERM, unless a disable policy says otherwise.
+const DefaultKillGraceSeconds = 10
 
-	if len(groups) == 1 { // just one group
-		list = groups[0]
-	} else if len(groups) == 0 {
-		err := errors.New("no groups of users actually provided")
-		return nil, err
-	} else {
-		listCap := 0
-		for _, y := range groups {
-			listCap += len(y)
+// DisablePolicy controls what's done to a user's account when they're
+// disabled. Settings left nil fall back to the next policy in line, and
+// finally to the built-in behavior of doing everything but expiring the
+// account and moving the home directory aside.
+type DisablePolicy struct {
+	LockPassword  *bool    `json:"lock_password" toml:"lock-password"`
+	NoLoginShell  *bool    `json:"nologin_shell" toml:"nologin-shell"`
+	DeleteKeys    *bool    `json:"delete_keys" toml:"delete-keys"`
+	ClearGroups   *bool    `json:"clear_groups" toml:"clear-groups"`
+	KeepGroups    []string `json:"keep_groups" toml:"keep-groups"`
+	KillProcesses *bool    `json:"kill_processes" toml:"kill-processes"`
+	// TerminateSessions asks systemd-logind to end the user's sessions
+	// before their processes are signalled.
+	TerminateSessions *bool `json:"terminate_sessions" toml:"terminate-sessions"`
+	// KillGraceSeconds is how long processes get to exit after SIGTERM
+	// before they're sent SIGKILL.
+	KillGraceSeconds *int  `json:"kill_grace_seconds" toml:"kill-grace-seconds"`
+	ExpireAccount    *bool `json:"expire_account" toml:"expire-account"`
+	MoveHome         *bool `json:"move_home" toml:"move-home"`
+	// DeleteAfterDays, if more than zero, deletes the user once they've
+	// been disabled for that many days.
+	DeleteAfterDays *int `json:"delete_after_days" toml:"delete-after-days"`
+	// NoticeMinutes, if more than zero, warns the user's sessions and
+	// waits that many minutes before actually disabling them.
+	NoticeMinutes *int `json:"notice_minutes" toml:"notice-minutes"`
+}
+
+// DisableSteps is a DisablePolicy with everything filled in.
+type DisableSteps struct {
+	LockPassword      bool
+	NoLoginShell      bool
+	DeleteKeys        bool
+	ClearGroups       bool
+	KeepGroups        []string
+	KillProcesses     bool
+	TerminateSessions bool
+	KillGraceSeconds  int
+	ExpireAccount     bool
+	MoveHome          bool
+	// DeleteAfterDays is zero if the user should never be deleted.
+	DeleteAfterDays int
+	// NoticeMinutes is zero if the user should be disabled right away.
+	NoticeMinutes int
+}
+
+// Inherit returns a copy of the policy with any settings left nil filled in
+// from parent. Either one may be nil.
+func (p *DisablePolicy) Inherit(parent *DisablePolicy) *DisablePolicy {
+	if p == nil && parent == nil {
+		return nil
+	}
+	np := new(DisablePolicy)
+	if p != nil {
+		*np = *p
+	}
+	if parent == nil {
+		return np
+	}
+	for _, f := range []struct {
+		dst **bool
+		src *bool
+	}{
+		{&np.LockPassword, parent.LockPassword},
+		{&np.NoLoginShell, parent.NoLoginShell},
+		{&np.DeleteKeys, parent.DeleteKeys},
+		{&np.ClearGroups, parent.ClearGroups},
+		{&np.KillProcesses, parent.KillProcesses},
+		{&np.TerminateSessions, parent.TerminateSessions},
+		{&np.ExpireAccount, parent.ExpireAccount},
+		{&np.MoveHome, parent.MoveHome},
+	} {
+		if *f.dst == nil {
+			*f.dst = f.src
 		}
-		list = make([]*Member, 0, listCap)
-		for _, l := range groups {
-			list = append(list, l...)
+	}
+	if np.KeepGroups == nil {
+		np.KeepGroups = parent.KeepGroups
+	}
+	if np.KillGraceSeconds == nil {
+		np.KillGraceSeconds = parent.KillGraceSeconds
+	}
+	if np.DeleteAfterDays == nil {
+		np.DeleteAfterDays = parent.DeleteAfterDays
+	}
+	if np.NoticeMinutes == nil {
+		np.NoticeMinutes = parent.NoticeMinutes
+	}
+	return np
+}
+
+// Resolve fills in anything the policy leaves unset with the built-in
+// defaults. A nil policy resolves to the built-in defaults.
+func (p *DisablePolicy) Resolve() DisableSteps {
+	ds := DisableSteps{LockPassword: true, NoLoginShell: true, DeleteKeys: true, ClearGroups: true, KillProcesses: true, TerminateSessions: true, KillGraceSeconds: DefaultKillGraceSeconds}
+	if p == nil {
+		return ds
+	}
+	for _, f := range []struct {
+		dst *bool
+		src *bool
+	}{
+		{&ds.LockPassword, p.LockPassword},
+		{&ds.NoLoginShell, p.NoLoginShell},
+		{&ds.DeleteKeys, p.DeleteKeys},
+		{&ds.ClearGroups, p.ClearGroups},
+		{&ds.KillProcesses, p.KillProcesses},
+		{&ds.TerminateSessions, p.TerminateSessions},
+		{&ds.ExpireAccount, p.ExpireAccount},
+		{&ds.MoveHome, p.MoveHome},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
 		}
 	}
+	ds.KeepGroups = p.KeepGroups
+	if p.KillGraceSeconds != nil && *p.KillGraceSeconds >= 0 {
+		ds.KillGraceSeconds = *p.KillGraceSeconds
+	}
+	if p.DeleteAfterDays != nil {
+		ds.DeleteAfterDays = *p.DeleteAfterDays
+	}
+	if p.NoticeMinutes != nil {
+		ds.NoticeMinutes = *p.NoticeMinutes
+	}
+	return ds
+}
 
-	// Remove the dupes now. Even just one group can have duplicate entries,
-	// so snip them out regardless of list length.
-	sort.Sort(GroupMembers(list))
+// Inherit returns a copy of the defaults with any settings left empty filled
+// in from parent. Either one may be nil.
+func (d *Defaults) Inherit(parent *Defaults) *Defaults {
+	if d == nil && parent == nil {
+		return nil
+	}
+	nd := new(Defaults)
+	if d != nil {
+		*nd = *d
+	}
+	if parent == nil {
+		return nd
+	}
+	if nd.Shell == "" {
+		nd.Shell = parent.Shell
+	}
+	if nd.PrimaryGroup == "" {
+		nd.PrimaryGroup = parent.PrimaryGroup
+	}
+	if nd.HomeBase == "" {
+		nd.HomeBase = parent.HomeBase
+	}
+	if nd.CreateHome == nil {
+		nd.CreateHome = parent.CreateHome
+	}
+	if nd.InactiveDays == nil {
+		nd.InactiveDays = parent.InactiveDays
+	}
+	nd.Disable = nd.Disable.Inherit(parent.Disable)
+	return nd
+}
 
-	var listSort string
-	for w, q := range list {
-		listSort = fmt.Sprintf("%s %d %+v", listSort, w, q)
+// FetchFunc looks up the definition of the group stored under key.
+type FetchFunc func(key string) (*Definition, error)
+
+// ExpandIncludes returns the members of a group along with the members of
+// every group it includes, recursively. Included groups are looked up with
+// fetch. Members of included groups also get the common groups of the groups
+// including them, and a user disabled in a group is disabled in every group
+// that group includes as well. A group that includes itself, directly or
+// further down the chain, is skipped with a warning rather than looping
+// forever. Group defaults are inherited the same way, with the included
+// group's own defaults taking precedence over those of the groups including
+// it.
+func ExpandIncludes(def *Definition, fetch FetchFunc) ([]*Member, error) {
+	return expandIncludes(def, fetch, nil, nil, nil, nil)
+}
+
+func expandIncludes(def *Definition, fetch FetchFunc, path []string, disabled map[string]bool, inherited []string, inheritedDefaults *Defaults) ([]*Member, error) {
+	via := path
+	path = append(path[:len(path):len(path)], def.Key)
+
+	dis := make(map[string]bool, len(disabled)+len(def.Members))
+	for k := range disabled {
+		dis[k] = true
+	}
+	for _, m := range def.Members {
+		if m.Status == Disabled {
+			dis[m.Username] = true
+		}
 	}
-	logger.Debugf("sorted list: %v", listSort)
 
-	// borrowing from goiardi some here
-	for i, u := range list {
-		logger.Debugf("user in RemoveDupeUsers: %+v", u)
-		if i > len(list) {
-			break
+	list := make([]*Member, 0, len(def.Members))
+	for _, m := range def.Members {
+		nm := *m
+		if len(inherited) > 0 {
+			nm.CommonGroups = append(append([]string{}, m.CommonGroups...), inherited...)
 		}
-		j := 1
-		s := 0
-		for {
-			if i+j >= len(list) {
-				break
-			}
-			if u.Username == list[i+j].Username {
-				j++
-				s++
-				u.CommonGroups = append(u.CommonGroups, list[i+j].CommonGroups...)
-			} else {
-				break
-			}
-		}
-		if s == 0 {
+		if dis[m.Username] && m.Status != Disabled {
+			logger.Debugf("%s is disabled in a group including %s, disabling them here too", m.Username, def.Key)
+			nm.Status = Disabled
+		}
+		nm.Via = via
+		nm.Defaults = m.Defaults.Inherit(inheritedDefaults)
+		list = append(list, &nm)
+	}
+
+	if len(def.Include) == 0 {
+		return list, nil
+	}
+
+	common := append(append([]string{}, inherited...), def.CommonGroups...)
+	for _, inc := range def.Include {
+		if stringInSlice(inc, path) {
+			logger.Warningf("group %s includes %s, which would make a cycle (%s -> %s); skipping it", def.Key, inc, strings.Join(path, " -> "), inc)
 			continue
 		}
-		if u.Status != Enabled {
-			for z := i + 1; z < (i+s)-1; z++ {
-				if list[z].Status == Enabled {
-					u.Status = Enabled
-					break
-				}
-			}
+		child, err := fetch(inc)
+		if err != nil {
+			err = fmt.Errorf("error expanding groups included by %s: %s", def.Key, err.Error())
+			return nil, err
 		}
+		// make sure the key is what was actually asked for
+		child.Key = inc
+		cm, err := expandIncludes(child, fetch, path, dis, common, def.Defaults.Inherit(inheritedDefaults))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, cm...)
+	}
+
+	return list, nil
+}
 
-		list = delTwoPosElements(i+1, s, list)
+func (d *Defaults) conflicts(o *Defaults) bool {
+	if d == nil || o == nil {
+		return false
 	}
+	diff := func(a, b string) bool { return a != "" && b != "" && a != b }
+	if diff(d.Shell, o.Shell) || diff(d.PrimaryGroup, o.PrimaryGroup) || diff(d.HomeBase, o.HomeBase) {
+		return true
+	}
+	if d.CreateHome != nil && o.CreateHome != nil && *d.CreateHome != *o.CreateHome {
+		return true
+	}
+	return d.Disable != nil && o.Disable != nil && !reflect.DeepEqual(d.Disable.Resolve(), o.Disable.Resolve())
+}
+
+// mergeDefaults settles the group defaults for a user listed in more than one
+// group. Groups the user is directly a member of come before groups they're
+// only in through an include, and otherwise groups are taken in order of
+// their keys. The first group to set a particular default wins.
+func mergeDefaults(entries []*Member) *Defaults {
+	ordered := make([]*Member, len(entries))
+	copy(ordered, entries)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if len(ordered[i].Via) != len(ordered[j].Via) {
+			return len(ordered[i].Via) < len(ordered[j].Via)
+		}
+		return ordered[i].GroupKey < ordered[j].GroupKey
+	})
 
-	for _, gu := range list {
-		sort.Strings(gu.CommonGroups)
-		gu.CommonGroups = util.RemoveDupeSliceString(gu.CommonGroups)
+	var d *Defaults
+	for _, e := range ordered {
+		if e.Defaults == nil {
+			continue
+		}
+		if d.conflicts(e.Defaults) {
+			logger.Debugf("%s has group defaults in %s that are overridden by an earlier group", e.Username, e.GroupKey)
+		}
+		d = d.Inherit(e.Defaults)
 	}
+	return d
+}
 
-	listSort = ""
+func stringInSlice(s string, sl []string) bool {
+	for _, v := range sl {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MergePolicy decides which status wins when a user is listed in more than
+// one group with different statuses.
+type MergePolicy string
+
+const (
+	// EnabledWins enables a user if any of their groups has them enabled.
+	EnabledWins MergePolicy = "enabled-wins"
+	// DisabledWins disables a user if any of their groups has them
+	// disabled.
+	DisabledWins MergePolicy = "disabled-wins"
+)
+
+// DefaultMergePolicy is the merge policy used when none is configured. It
+// matches how spqr has always resolved conflicting statuses.
+const DefaultMergePolicy = EnabledWins
+
+// ParseMergePolicy turns a string from the config into a MergePolicy. An empty
+// string gives the default policy.
+func ParseMergePolicy(p string) (MergePolicy, error) {
+	switch mp := MergePolicy(strings.ToLower(p)); mp {
+	case "":
+		return DefaultMergePolicy, nil
+	case EnabledWins, DisabledWins:
+		return mp, nil
+	default:
+		err := fmt.Errorf("unknown membership merge policy '%s': must be '%s' or '%s'", p, EnabledWins, DisabledWins)
+		return "", err
+	}
+}
+
+// MergeDecision records how a user's final status was settled when their
+// group memberships were merged.
+type MergeDecision struct {
+	Username string
+	Status   string
+	Policy   MergePolicy
+	Entries  []MergeEntry
+	Reason   string
+}
+
+// MergeEntry is one of the group entries considered for a MergeDecision.
+type MergeEntry struct {
+	GroupKey string
+	Via      []string
+	Status   string
+}
+
+// Conflict reports whether the user's groups disagreed about their status.
+func (d *MergeDecision) Conflict() bool {
+	for _, e := range d.Entries {
+		if e.Status != d.Status {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *MergeDecision) String() string {
+	ents := make([]string, len(d.Entries))
+	for i, e := range d.Entries {
+		k := e.GroupKey
+		if k == "" {
+			k = "(unknown group)"
+		}
+		if len(e.Via) > 0 {
+			k = fmt.Sprintf("%s (via %s)", k, strings.Join(e.Via, " -> "))
+		}
+		ents[i] = fmt.Sprintf("%s=%s", k, e.Status)
+	}
+	return fmt.Sprintf("%s: %s (%s) [%s]", d.Username, d.Status, d.Reason, strings.Join(ents, ", "))
+}
+
+// Selector picks group members by the labels in their user definitions. A user
+// matches when every label in the selector is present with the same value.
+type Selector map[string]string
+
+// Matches reports whether the labels satisfy the selector. An empty selector
+// matches nobody.
+func (s Selector) Matches(labels map[string]string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for k, v := range s {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%s", k, s[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// AddSelectedMembers adds the users matched by a group's selector to the
+// group's explicit member list as enabled members. Users already listed in
+// the group's members are left alone, so an explicit entry always beats a
+// selector match.
+func AddSelectedMembers(members []*Member, selected []string, commonGroups []string, groupKey string, defaults *Defaults) []*Member {
+	listed := make(map[string]bool, len(members))
+	for _, m := range members {
+		listed[m.Username] = true
+	}
+	for _, name := range selected {
+		if listed[name] {
+			continue
+		}
+		m := &Member{Username: name, Status: Enabled, CommonGroups: commonGroups, GroupKey: groupKey, Defaults: defaults}
+		members = append(members, m)
+		listed[name] = true
+	}
+	return members
+}
+
+type GroupMembers []*Member
+
+func (gm GroupMembers) Len() int      { return len(gm) }
+func (gm GroupMembers) Swap(i, j int) { gm[i], gm[j] = gm[j], gm[i] }
+func (gm GroupMembers) Less(i, j int) bool {
+	if gm[i].Username == gm[j].Username {
+		return gm[i].GroupKey < gm[j].GroupKey
+	}
+	return gm[i].Username < gm[j].Username
+}
+
+// RemoveDupeUsers merges the member lists of one or more groups into a single
+// list with one entry per user. When a user appears more than once their
+// common groups are combined and their status is settled with the given merge
+// policy. A MergeDecision is returned for every user in the merged list.
+func RemoveDupeUsers(groups [][]*Member, policy MergePolicy) ([]*Member, []*MergeDecision, error) {
+	if len(groups) == 0 {
+		err := errors.New("no groups of users actually provided")
+		return nil, nil, err
+	}
+
+	listCap := 0
+	for _, y := range groups {
+		listCap += len(y)
+	}
+	list := make([]*Member, 0, listCap)
+	for _, l := range groups {
+		list = append(list, l...)
+	}
+
+	// Even just one group can have duplicate entries, so merge them
+	// regardless of how many groups there are.
+	sort.Sort(GroupMembers(list))
+
+	var listSort string
 	for w, q := range list {
 		listSort = fmt.Sprintf("%s %d %+v", listSort, w, q)
 	}
+	logger.Debugf("sorted list: %v", listSort)
+
+	merged := make([]*Member, 0, len(list))
+	decisions := make([]*MergeDecision, 0, len(list))
+
+	for i := 0; i < len(list); {
+		j := i + 1
+		for j < len(list) && list[j].Username == list[i].Username {
+			j++
+		}
+		m, d := MergeMember(list[i:j], policy)
+		merged = append(merged, m)
+		decisions = append(decisions, d)
+		i = j
+	}
+
+	listSort = ""
+	for w, q := range merged {
+		listSort = fmt.Sprintf("%s %d %+v", listSort, w, q)
+	}
 	logger.Debugf("the sorted and de-duped list: %v", listSort)
-	return list, nil
+	return merged, decisions, nil
 }
 
-// borrowing from some goiardi work here too
-func delTwoPosElements(pos int, skip int, gm []*Member) []*Member {
-	gm = append(gm[:pos], gm[pos+skip:]...)
-	return gm
+// MergeMember combines every entry for a single user into one Member, using
+// the merge policy to settle the user's status. The merged member's group key,
+// ModifyIndex, and include path are taken from the first entry with the status
+// that won, so they name a group that actually decided the outcome. The
+// entries are not modified.
+func MergeMember(entries []*Member, policy MergePolicy) (*Member, *MergeDecision) {
+	m := &Member{Username: entries[0].Username, Status: entries[0].Status, GroupKey: entries[0].GroupKey, ModifyIndex: entries[0].ModifyIndex, Via: entries[0].Via}
+	d := &MergeDecision{Username: m.Username, Policy: policy, Entries: make([]MergeEntry, len(entries))}
+
+	var nEnabled, nDisabled int
+	agree := true
+	for i, e := range entries {
+		if e.Status != m.Status {
+			agree = false
+		}
+		m.CommonGroups = append(m.CommonGroups, e.CommonGroups...)
+		d.Entries[i] = MergeEntry{GroupKey: e.GroupKey, Via: e.Via, Status: e.Status}
+		switch e.Status {
+		case Enabled:
+			nEnabled++
+		case Disabled:
+			nDisabled++
+		}
+	}
+	sort.Strings(m.CommonGroups)
+	m.CommonGroups = util.RemoveDupeSliceString(m.CommonGroups)
+	m.Defaults = mergeDefaults(entries)
+
+	switch {
+	case len(entries) == 1:
+		d.Reason = "listed in only one group"
+	case agree:
+		d.Reason = fmt.Sprintf("all %d entries agree", len(entries))
+	case policy == DisabledWins && nDisabled > 0:
+		m.Status = Disabled
+		d.Reason = fmt.Sprintf("disabled in %d of %d entries, and disabled wins", nDisabled, len(entries))
+	case nEnabled > 0:
+		m.Status = Enabled
+		if policy == DisabledWins {
+			d.Reason = fmt.Sprintf("enabled in %d of %d entries, and no entry disabled the user", nEnabled, len(entries))
+		} else {
+			d.Reason = fmt.Sprintf("enabled in %d of %d entries, and enabled wins", nEnabled, len(entries))
+		}
+	default:
+		d.Reason = fmt.Sprintf("no entry enabled or disabled the user, keeping status from %s", m.GroupKey)
+	}
+	d.Status = m.Status
+	for _, e := range entries {
+		if e.Status == m.Status {
+			m.GroupKey, m.ModifyIndex, m.Via = e.GroupKey, e.ModifyIndex, e.Via
+			break
+		}
+	}
+
+	return m, d
 }
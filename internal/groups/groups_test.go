@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package groups
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func member(username, status, groupKey string, commonGroups ...string) *Member {
+	return &Member{Username: username, Status: status, GroupKey: groupKey, CommonGroups: commonGroups}
+}
+
+func TestMergeMemberPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*Member
+		policy  MergePolicy
+		want    string
+	}{
+		{"single entry", []*Member{member("baz", Disabled, "a")}, EnabledWins, Disabled},
+		{"all agree", []*Member{member("baz", Enabled, "a"), member("baz", Enabled, "b")}, DisabledWins, Enabled},
+		{"enabled wins", []*Member{member("baz", Disabled, "a"), member("baz", Enabled, "b")}, EnabledWins, Enabled},
+		{"disabled wins", []*Member{member("baz", Enabled, "a"), member("baz", Disabled, "b")}, DisabledWins, Disabled},
+		{"disabled wins, nothing disabled", []*Member{member("baz", Enabled, "a"), member("baz", "", "b")}, DisabledWins, Enabled},
+		{"neither", []*Member{member("baz", "", "a"), member("baz", "other", "b")}, EnabledWins, ""},
+	}
+	for _, tt := range tests {
+		m, d := MergeMember(tt.entries, tt.policy)
+		if m.Status != tt.want {
+			t.Errorf("%s: got status '%s', wanted '%s'", tt.name, m.Status, tt.want)
+		}
+		if d.Status != m.Status {
+			t.Errorf("%s: decision status '%s' doesn't match member status '%s'", tt.name, d.Status, m.Status)
+		}
+		if len(d.Entries) != len(tt.entries) {
+			t.Errorf("%s: decision has %d entries, wanted %d", tt.name, len(d.Entries), len(tt.entries))
+		}
+	}
+}
+
+func TestMergeMemberSourceIsWinningEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*Member
+		policy  MergePolicy
+		want    string
+	}{
+		{"enabled wins", []*Member{member("baz", Disabled, "a"), member("baz", Enabled, "b")}, EnabledWins, "b"},
+		{"disabled wins", []*Member{member("baz", Enabled, "a"), member("baz", Disabled, "b"), member("baz", Disabled, "c")}, DisabledWins, "b"},
+		{"all agree", []*Member{member("baz", Enabled, "a"), member("baz", Enabled, "b")}, EnabledWins, "a"},
+		{"neither", []*Member{member("baz", "", "a"), member("baz", "other", "b")}, EnabledWins, "a"},
+	}
+	for _, tt := range tests {
+		for i, e := range tt.entries {
+			e.ModifyIndex = uint64(i + 1)
+			e.Via = []string{e.GroupKey + "-parent"}
+		}
+		m, _ := MergeMember(tt.entries, tt.policy)
+		var winner *Member
+		for _, e := range tt.entries {
+			if e.GroupKey == tt.want {
+				winner = e
+			}
+		}
+		if m.GroupKey != winner.GroupKey || m.ModifyIndex != winner.ModifyIndex || !reflect.DeepEqual(m.Via, winner.Via) {
+			t.Errorf("%s: merged member came from %s (index %d, via %v), wanted %s", tt.name, m.GroupKey, m.ModifyIndex, m.Via, tt.want)
+		}
+	}
+}
+
+func TestMergeMemberLeavesEntriesAlone(t *testing.T) {
+	entries := []*Member{member("baz", Disabled, "a", "wheel"), member("baz", Enabled, "b", "users")}
+	MergeMember(entries, EnabledWins)
+	if entries[0].Status != Disabled || !reflect.DeepEqual(entries[0].CommonGroups, []string{"wheel"}) {
+		t.Errorf("MergeMember changed the first entry: %+v", entries[0])
+	}
+}
+
+func TestRemoveDupeUsers(t *testing.T) {
+	lists := [][]*Member{
+		{member("quux", Enabled, "a", "wheel"), member("baz", Disabled, "a", "wheel")},
+		{member("baz", Disabled, "b", "users"), member("qux", Enabled, "b", "users")},
+		{member("baz", Enabled, "c", "adm")},
+	}
+	for _, policy := range []MergePolicy{EnabledWins, DisabledWins} {
+		merged, decisions, err := RemoveDupeUsers(lists, policy)
+		if err != nil {
+			t.Fatalf("%s: %s", policy, err.Error())
+		}
+		var names []string
+		for _, m := range merged {
+			names = append(names, m.Username)
+		}
+		if want := []string{"baz", "quux", "qux"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: got users %v, wanted %v", policy, names, want)
+		}
+		if len(decisions) != len(merged) {
+			t.Errorf("%s: got %d decisions for %d users", policy, len(decisions), len(merged))
+		}
+		// baz's common groups come from all three entries, the last one
+		// included.
+		if want := []string{"adm", "users", "wheel"}; !reflect.DeepEqual(merged[0].CommonGroups, want) {
+			t.Errorf("%s: got common groups %v for baz, wanted %v", policy, merged[0].CommonGroups, want)
+		}
+	}
+}
+
+// The dedupe loop used to stop one entry short, so when only the last of a
+// user's entries enabled them they stayed disabled.
+func TestRemoveDupeUsersLastEntryCounts(t *testing.T) {
+	lists := [][]*Member{
+		{member("baz", Disabled, "a")},
+		{member("baz", Disabled, "b")},
+		{member("baz", Enabled, "c")},
+	}
+	merged, _, err := RemoveDupeUsers(lists, EnabledWins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 1 {
+		t.Fatalf("got %d users, wanted 1", len(merged))
+	}
+	if merged[0].Status != Enabled {
+		t.Errorf("got status '%s' for baz, wanted '%s'", merged[0].Status, Enabled)
+	}
+}
+
+// The dedupe loop used to read past the end of the list when the last user
+// in it was listed more than once.
+func TestRemoveDupeUsersTrailingDupes(t *testing.T) {
+	lists := [][]*Member{
+		{member("aaa", Enabled, "a"), member("zzz", Enabled, "a"), member("zzz", Enabled, "a")},
+	}
+	merged, _, err := RemoveDupeUsers(lists, EnabledWins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 2 {
+		t.Errorf("got %d users, wanted 2: %+v", len(merged), merged)
+	}
+}
+
+func TestRemoveDupeUsersNoGroups(t *testing.T) {
+	if _, _, err := RemoveDupeUsers(nil, EnabledWins); err == nil {
+		t.Errorf("expected an error with no groups")
+	}
+}
+
+func TestParseMergePolicy(t *testing.T) {
+	for in, want := range map[string]MergePolicy{"": EnabledWins, "Disabled-Wins": DisabledWins, "enabled-wins": EnabledWins} {
+		got, err := ParseMergePolicy(in)
+		if err != nil || got != want {
+			t.Errorf("ParseMergePolicy('%s') = '%s', %v; wanted '%s'", in, got, err, want)
+		}
+	}
+	if _, err := ParseMergePolicy("whoever-wins"); err == nil {
+		t.Errorf("expected an error for an unknown policy")
+	}
+}
+
+func TestMemberWindowJSON(t *testing.T) {
+	m := member("baz", Enabled, "a")
+	raw, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "valid_") {
+		t.Errorf("member with no validity window was serialized as %s", raw)
+	}
+
+	until := time.Date(2018, 6, 1, 9, 0, 0, 0, time.UTC)
+	m.ValidUntil = &until
+	if raw, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), `"valid_until":"2018-06-01T09:00:00Z"`) || strings.Contains(string(raw), "valid_from") {
+		t.Errorf("member with only an end to their validity window was serialized as %s", raw)
+	}
+}
+
+func TestApplyValidity(t *testing.T) {
+	now := time.Date(2018, 6, 1, 9, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	open := member("baz", Enabled, "a")
+	notYet := member("qux", Enabled, "a")
+	notYet.ValidFrom = &later
+	next := ApplyValidity([]*Member{open, notYet}, now)
+	if open.Status != Enabled {
+		t.Errorf("member with no validity window was changed to %s", open.Status)
+	}
+	if notYet.Status != Disabled {
+		t.Errorf("member whose window hasn't opened yet is %s", notYet.Status)
+	}
+	if !next.Equal(later) {
+		t.Errorf("next change is %s, wanted %s", next, later)
+	}
+}
@@ -14,30 +14,223 @@
  * limitations under the License.
  */
 
+// Package processes finds and ends the processes belonging to a user.
 package processes
 
 import (
+	"errors"
+	"fmt"
 	"github.com/tideland/golib/logger"
+	"os"
+	"regexp"
+	"syscall"
+	"time"
 )
 
-func KillUserProcesses(uid string) error {
-	// Go through the process list twice, to be on the safe-ish side
-	for i := 0; i < 2; i++ {
-		// awfully OS specific, so...
-		procs, err := findUserProcesses(uid)
+// DefaultGracePeriod is how long processes are given to exit after being sent
+// SIGTERM before they're killed outright.
+const DefaultGracePeriod = 10 * time.Second
+
+const (
+	pollInterval = 100 * time.Millisecond
+	// killPasses is how many times to go looking for stragglers to SIGKILL,
+	// in case something forked in the meantime.
+	killPasses = 5
+)
+
+// Outcomes for processes that were ended.
+const (
+	OutcomeSessionTerminated = "ended by terminating the user's logind sessions"
+	OutcomeTerminated        = "exited after SIGTERM"
+	OutcomeCgroupKilled      = "killed along with the rest of the user's cgroup"
+	OutcomeKilled            = "killed with SIGKILL"
+	OutcomeGone              = "already gone"
+	OutcomeSurvived          = "still running after SIGKILL"
+	OutcomeProtected         = "left alone, it matches a protected process pattern"
+)
+
+// ProcessReport describes what happened to a single process.
+type ProcessReport struct {
+	Pid     int
+	Cmdline string
+	Outcome string
+}
+
+func (r *ProcessReport) String() string {
+	return fmt.Sprintf("pid %d (%s): %s", r.Pid, r.Cmdline, r.Outcome)
+}
+
+// KillOptions controls how KillUserProcesses goes about ending processes.
+type KillOptions struct {
+	// TerminateSessions asks systemd-logind to terminate the user's
+	// sessions first, if logind is running.
+	TerminateSessions bool
+	// GracePeriod is how long to wait after sending SIGTERM before sending
+	// SIGKILL. Zero sends SIGKILL right after SIGTERM.
+	GracePeriod time.Duration
+	// Protected processes, matched against their command lines, are
+	// never signalled.
+	Protected []*regexp.Regexp
+}
+
+// KillUserProcesses ends every process belonging to the user with the given
+// uid, in stages. First the user's sessions are terminated through logind
+// (if asked and if logind is running), then any remaining processes are sent
+// SIGTERM and given the grace period to exit, and finally whatever's left is
+// killed with SIGKILL, through the user's cgroup where possible. A process
+// belongs to the user if any of its uids do. It returns a report on every
+// process it came across.
+func KillUserProcesses(uid string, opts *KillOptions) ([]*ProcessReport, error) {
+	if opts == nil {
+		opts = &KillOptions{TerminateSessions: true, GracePeriod: DefaultGracePeriod}
+	}
+	reports := make(map[int]*ProcessReport)
+	var order []int
+	spared := false
+
+	// awfully OS specific, so...
+	scan := func() (map[int]bool, error) {
+		pids, err := findUserProcesses(uid)
+		if err != nil {
+			return nil, err
+		}
+		running := make(map[int]bool, len(pids))
+		for _, p := range pids {
+			r, ok := reports[p]
+			if !ok {
+				r = &ProcessReport{Pid: p, Cmdline: processCmdline(p)}
+				if protectedProcess(r.Cmdline, opts.Protected) {
+					r.Outcome = OutcomeProtected
+					spared = true
+				}
+				reports[p] = r
+				order = append(order, p)
+			}
+			if r.Outcome != OutcomeProtected {
+				running[p] = true
+			}
+		}
+		return running, nil
+	}
+	// mark anything that was running before but isn't any longer
+	settle := func(running map[int]bool, outcome string) {
+		for _, p := range order {
+			if r := reports[p]; r.Outcome == "" && !running[p] {
+				r.Outcome = outcome
+			}
+		}
+	}
+	finish := func() []*ProcessReport {
+		rs := make([]*ProcessReport, len(order))
+		for i, p := range order {
+			rs[i] = reports[p]
+			logger.Infof("process for uid %s: %s", uid, rs[i])
+		}
+		return rs
+	}
+
+	running, err := scan()
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Found %d processes for uid '%s'", len(running), uid)
+	if len(running) == 0 {
+		return nil, nil
+	}
+
+	// Terminating the user's sessions would take any protected processes
+	// down along with everything else.
+	if opts.TerminateSessions && !spared && logindRunning() {
+		if err := terminateSessions(uid); err != nil {
+			logger.Warningf("could not terminate sessions for uid %s through logind: %s", uid, err.Error())
+		} else {
+			running, err = waitForExit(scan, opts.GracePeriod)
+			if err != nil {
+				return nil, err
+			}
+			settle(running, OutcomeSessionTerminated)
+		}
+	}
+
+	if len(running) > 0 {
+		signalAll(running, syscall.SIGTERM, reports)
+		running, err = waitForExit(scan, opts.GracePeriod)
+		if err != nil {
+			return nil, err
+		}
+		settle(running, OutcomeTerminated)
+	}
+
+	// Kill the user's whole cgroup, where there is one, so nothing in it
+	// can fork its way out from under us. That would take any protected
+	// processes down with it though, so not if there are any.
+	if len(running) > 0 && !spared {
+		killed, err := killUserCgroup(uid)
+		if err != nil {
+			logger.Warningf("could not kill the cgroup for uid %s: %s", uid, err.Error())
+		} else if killed {
+			running, err = waitForExit(scan, time.Second)
+			if err != nil {
+				return nil, err
+			}
+			settle(running, OutcomeCgroupKilled)
+		}
+	}
+
+	// Anything left is outside the user's cgroup, like setuid processes
+	// or processes started by cron, so go after them one by one until
+	// there aren't any more.
+	for i := 0; i < killPasses && len(running) > 0; i++ {
+		signalAll(running, syscall.SIGKILL, reports)
+		time.Sleep(pollInterval)
+		running, err = scan()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		logger.Debugf("Found %d processes for uid '%s' in round %d", len(procs), uid, i+1)
+		settle(running, OutcomeKilled)
+	}
+	settle(nil, OutcomeKilled)
+	for p := range running {
+		reports[p].Outcome = OutcomeSurvived
+	}
+
+	return finish(), nil
+}
+
+func protectedProcess(cmdline string, protected []*regexp.Regexp) bool {
+	for _, re := range protected {
+		if re.MatchString(cmdline) {
+			return true
+		}
+	}
+	return false
+}
 
-		if len(procs) == 0 {
-			return nil
+func signalAll(running map[int]bool, sig syscall.Signal, reports map[int]*ProcessReport) {
+	for p := range running {
+		pr, _ := os.FindProcess(p) // it will always find a proc, even
+		// if it doesn't actually exist.
+		if err := pr.Signal(sig); err != nil {
+			logger.Debugf("sending %s to pid %d failed: %s", sig, p, err.Error())
+			if r := reports[p]; r.Outcome == "" && errors.Is(err, os.ErrProcessDone) {
+				r.Outcome = OutcomeGone
+			}
 		}
+	}
+}
 
-		// now kill the processes
-		for _, p := range procs {
-			p.Kill()
+// waitForExit rescans the user's processes until they're all gone or the
+// grace period runs out, and returns whatever's still running.
+func waitForExit(scan func() (map[int]bool, error), grace time.Duration) (map[int]bool, error) {
+	deadline := time.Now().Add(grace)
+	for {
+		running, err := scan()
+		if err != nil {
+			return nil, err
+		}
+		if len(running) == 0 || !time.Now().Before(deadline) {
+			return running, nil
 		}
+		time.Sleep(pollInterval)
 	}
-	return nil
 }
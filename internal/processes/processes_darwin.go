@@ -20,9 +20,24 @@ package processes
 
 import (
 	"errors"
-	"os"
 )
 
-func findUserProcesses(uid int) ([]*os.Process, error) {
+func findUserProcesses(uid string) ([]int, error) {
 	return nil, errors.New("Can't look for processes in darwin either (not sure how you managed to get here, for that matter.")
 }
+
+func processCmdline(pid int) string {
+	return "unknown"
+}
+
+func killUserCgroup(uid string) (bool, error) {
+	return false, nil
+}
+
+func logindRunning() bool {
+	return false
+}
+
+func terminateSessions(uid string) error {
+	return errors.New("terminating sessions is not supported on darwin")
+}
@@ -19,22 +19,31 @@
 package processes
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
+	"github.com/ctdk/spqr/internal/command"
 	"github.com/tideland/golib/logger"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
 	dentryToRead = 10
-	statusBytes  = 512
+	cgroupRoot   = "/sys/fs/cgroup"
 )
 
 var statusUid = []byte("Uid:")
 
-func findUserProcesses(uid string) ([]*os.Process, error) {
+func findUserProcesses(uid string) ([]int, error) {
 	// start looking for real
 	procdir, err := os.Open("/proc")
 	if err != nil {
@@ -66,65 +75,190 @@ func findUserProcesses(uid string) ([]*os.Process, error) {
 				continue
 			}
 
-			// Try and read the info from /proc/PID/stat. If it
-			// fails the process may have disappeared or ended, so
-			// there's no need to blow up.
-			statusPath := path.Join("/proc", n, "status")
-			status, err := os.Open(statusPath)
+			uids, err := processUids(n)
 			if err != nil {
-				logger.Debugf("Process status %s open failed, moving on: %s", n, err.Error())
+				// If it fails the process may have disappeared
+				// or ended, so there's no need to blow up.
+				logger.Debugf("Process status %s read failed, moving on: %s", n, err.Error())
 				continue
 			}
-			defer status.Close()
-
-			statusContents := make([]byte, statusBytes)
-			var extraContent []byte
-			var xuid []byte
-
-		LineRead:
-			for {
-				nb, ferr := status.Read(statusContents[:statusBytes])
-				if ferr != nil {
-					if ferr == io.EOF {
-						break
-					}
-					return nil, ferr
-				}
-				// taking the easy way out
-				if extraContent != nil {
-					statusContents = append(extraContent, statusContents[:nb]...)
-					nb += len(extraContent)
-					extraContent = nil
-				}
-				lines := bytes.Split(statusContents[:nb], []byte("\n"))
-
-				for _, l := range lines {
-					if bytes.Equal(l[:4], statusUid) {
-						for i := 4; i < len(l); i++ {
-							if l[i] >= '0' && l[i] <= '9' {
-								for j := i; j < len(l); j++ {
-									if l[j] < '0' || l[j] > '9' {
-										xuid = l[i:j]
-										break LineRead
-									}
-								}
-							}
-						}
+
+			// The process belongs to the user if any of its real,
+			// effective, saved, or filesystem uids are theirs, so
+			// setuid processes are caught too.
+			for _, xuid := range uids {
+				if bytes.Equal(buid, xuid) {
+					pid, _ := strconv.Atoi(n)
+					// zombies are already dead, they just
+					// haven't been reaped yet
+					if !isZombie(pid) {
+						pids = append(pids, pid)
 					}
+					break
 				}
 			}
-			// all done reading from /proc/PID/status, phew
-			if bytes.Equal(buid, xuid) {
-				pid, _ := strconv.Atoi(n)
+		}
+	}
+	return pids, nil
+}
+
+// processUids reads the real, effective, saved, and filesystem uids of a
+// process out of /proc/PID/status.
+func processUids(pid string) ([][]byte, error) {
+	status, err := os.Open(path.Join("/proc", pid, "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer status.Close()
+
+	sc := bufio.NewScanner(status)
+	for sc.Scan() {
+		l := sc.Bytes()
+		if bytes.HasPrefix(l, statusUid) {
+			uids := bytes.Fields(l[len(statusUid):])
+			// the scanner reuses its buffer
+			for i, u := range uids {
+				uids[i] = append([]byte(nil), u...)
+			}
+			return uids, nil
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no Uid line found in /proc/%s/status", pid)
+}
+
+// userSlice returns the path to the user's systemd slice in the cgroup v2
+// hierarchy, or an empty string if there isn't one.
+func userSlice(uid string) string {
+	// cgroup.controllers only exists at the top of a cgroup v2 hierarchy
+	if _, err := os.Stat(path.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return ""
+	}
+	slice := path.Join(cgroupRoot, "user.slice", fmt.Sprintf("user-%s.slice", uid))
+	if _, err := os.Stat(slice); err != nil {
+		return ""
+	}
+	return slice
+}
+
+// killUserCgroup kills everything in the user's slice at once, so nothing in
+// it can fork its way out. Newer kernels can do this with cgroup.kill; on older
+// ones the slice is frozen, everything in it is sent SIGKILL, and then it's
+// thawed again. It returns false if there's no slice to kill.
+func killUserCgroup(uid string) (bool, error) {
+	slice := userSlice(uid)
+	if slice == "" {
+		return false, nil
+	}
+
+	killFile := path.Join(slice, "cgroup.kill")
+	if _, err := os.Stat(killFile); err == nil {
+		if err = ioutil.WriteFile(killFile, []byte("1"), 0644); err != nil {
+			return false, err
+		}
+		logger.Debugf("killed everything in %s", slice)
+		return true, nil
+	}
+
+	freezeFile := path.Join(slice, "cgroup.freeze")
+	if _, err := os.Stat(freezeFile); err != nil {
+		return false, nil
+	}
+	if err := ioutil.WriteFile(freezeFile, []byte("1"), 0644); err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := ioutil.WriteFile(freezeFile, []byte("0"), 0644); err != nil {
+			logger.Warningf("could not thaw %s: %s", slice, err.Error())
+		}
+	}()
+	waitForFrozen(slice)
+
+	var pids []int
+	err := filepath.Walk(slice, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "cgroup.procs" {
+			return nil
+		}
+		procs, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		for _, f := range bytes.Fields(procs) {
+			if pid, perr := strconv.Atoi(string(f)); perr == nil {
 				pids = append(pids, pid)
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	// SIGKILL still gets through to frozen processes
+	for _, pid := range pids {
+		if kerr := syscall.Kill(pid, syscall.SIGKILL); kerr != nil {
+			logger.Debugf("sending SIGKILL to pid %d failed: %s", pid, kerr.Error())
+		}
+	}
+	logger.Debugf("froze %s and killed the %d processes in it", slice, len(pids))
+	return true, nil
+}
+
+func waitForFrozen(slice string) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		events, err := ioutil.ReadFile(path.Join(slice, "cgroup.events"))
+		if err != nil || bytes.Contains(events, []byte("frozen 1")) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	procs := make([]*os.Process, len(pids))
-	for i, p := range pids {
-		pr, _ := os.FindProcess(p) // it will always find a proc, even
-		// if it doesn't actually exist.
-		procs[i] = pr
+}
+
+func isZombie(pid int) bool {
+	stat, err := ioutil.ReadFile(path.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// the state comes right after the command name, which is in parens
+	// and may have parens of its own.
+	i := bytes.LastIndexByte(stat, ')')
+	return i >= 0 && i+2 < len(stat) && stat[i+2] == 'Z'
+}
+
+// processCmdline gets a process's command line out of /proc, or its name if
+// it doesn't have one (like kernel threads or zombies).
+func processCmdline(pid int) string {
+	p := strconv.Itoa(pid)
+	raw, err := ioutil.ReadFile(path.Join("/proc", p, "cmdline"))
+	if err == nil && len(raw) > 0 {
+		return strings.TrimSpace(string(bytes.Replace(bytes.TrimRight(raw, "\x00"), []byte{0}, []byte{' '}, -1)))
+	}
+	if comm, cerr := ioutil.ReadFile(path.Join("/proc", p, "comm")); cerr == nil {
+		return fmt.Sprintf("[%s]", strings.TrimSpace(string(comm)))
+	}
+	return "unknown"
+}
+
+// logindRunning checks if systemd-logind is around to ask about sessions.
+func logindRunning() bool {
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return false
+	}
+	if _, err := exec.LookPath("loginctl"); err != nil {
+		return false
+	}
+	return true
+}
+
+func terminateSessions(uid string) error {
+	if _, err := command.Run("loginctl", "terminate-user", uid); err != nil {
+		return err
 	}
-	return procs, nil
+	logger.Debugf("asked logind to terminate sessions for uid %s", uid)
+	return nil
 }
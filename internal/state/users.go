@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package state
+
+import (
+	"encoding/json"
+	"github.com/tideland/golib/logger"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+const userStatePerm = 0600
+
+// UserRecord is what spqr remembers about a single user between runs.
+type UserRecord struct {
+	DisabledAt time.Time `json:"disabled_at"`
+	// DisableDue is when a user who has been given notice that they're
+	// being disabled will actually be disabled.
+	DisableDue time.Time `json:"disable_due"`
+	// DisableReason is why the user was, or will be, disabled.
+	DisableReason string `json:"disable_reason,omitempty"`
+	// ExpiredAt is when spqr expired the user's account while disabling
+	// them, so an expiry date set on purpose isn't mistaken for one.
+	ExpiredAt time.Time `json:"expired_at,omitempty"`
+}
+
+// UserState keeps track of per-user information, like when a user was
+// disabled, in a JSON file. Unlike the mmapped index state it can grow as
+// needed. It also remembers which blast radius override this node last used.
+// A nil *UserState is valid, and remembers nothing.
+type UserState struct {
+	path  string
+	Users map[string]*UserRecord `json:"users"`
+	// OverrideIndex is the ModifyIndex of the blast radius override key
+	// the last time it let a run through.
+	OverrideIndex uint64 `json:"override_index,omitempty"`
+	dirty         bool
+}
+
+// LoadUserState reads the user state from the given file. A missing file is
+// not an error; an empty state is returned instead.
+func LoadUserState(statePath string) (*UserState, error) {
+	us := &UserState{path: statePath, Users: make(map[string]*UserRecord)}
+
+	raw, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Debugf("user state file %s doesn't exist yet", statePath)
+			return us, nil
+		}
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return us, nil
+	}
+	if err = json.Unmarshal(raw, us); err != nil {
+		return nil, err
+	}
+	if us.Users == nil {
+		us.Users = make(map[string]*UserRecord)
+	}
+	return us, nil
+}
+
+// Save writes the user state out if anything has changed. The new state is
+// written to a temporary file and renamed into place, so a crash won't leave
+// a half written state file behind.
+func (us *UserState) Save() error {
+	if us == nil || !us.dirty {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(us, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(us.path), path.Base(us.path))
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err = tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = tmp.Chmod(userStatePerm); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, us.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	us.dirty = false
+	logger.Debugf("saved user state to %s", us.path)
+	return nil
+}
+
+// Get returns the record for a user, or nil if there isn't one.
+func (us *UserState) Get(username string) *UserRecord {
+	if us == nil {
+		return nil
+	}
+	return us.Users[username]
+}
+
+func (us *UserState) record(username string) *UserRecord {
+	r, ok := us.Users[username]
+	if !ok {
+		r = new(UserRecord)
+		us.Users[username] = r
+	}
+	return r
+}
+
+// MarkDisabled records when and why a user was disabled, unless they're
+// already recorded as disabled. It returns the time the user was first
+// recorded as disabled, which is the zero time if there's no state to record
+// it in.
+func (us *UserState) MarkDisabled(username string, t time.Time, reason string) time.Time {
+	if us == nil {
+		return time.Time{}
+	}
+	r := us.record(username)
+	if r.DisabledAt.IsZero() {
+		r.DisabledAt = t
+		if reason != "" {
+			r.DisableReason = reason
+		}
+		us.dirty = true
+	}
+	if !r.DisableDue.IsZero() {
+		r.DisableDue = time.Time{}
+		us.dirty = true
+	}
+	return r.DisabledAt
+}
+
+// MarkExpired records that spqr expired the user's account while disabling
+// them, unless it already has.
+func (us *UserState) MarkExpired(username string, t time.Time) {
+	if us == nil {
+		return
+	}
+	r := us.record(username)
+	if r.ExpiredAt.IsZero() {
+		r.ExpiredAt = t
+		us.dirty = true
+	}
+}
+
+// ScheduleDisable records that a user will be disabled at the given time, for
+// the given reason, unless they're already scheduled to be disabled. It
+// returns when the user is due to be disabled, which is the zero time if
+// there's no state to record it in.
+func (us *UserState) ScheduleDisable(username string, due time.Time, reason string) time.Time {
+	if us == nil {
+		return time.Time{}
+	}
+	r := us.record(username)
+	if r.DisableDue.IsZero() {
+		r.DisableDue = due
+		r.DisableReason = reason
+		us.dirty = true
+	}
+	return r.DisableDue
+}
+
+// NextDisableDue returns the earliest time a scheduled disable is due, or the
+// zero time if none are scheduled.
+func (us *UserState) NextDisableDue() time.Time {
+	var next time.Time
+	if us == nil {
+		return next
+	}
+	for _, r := range us.Users {
+		if !r.DisableDue.IsZero() && (next.IsZero() || r.DisableDue.Before(next)) {
+			next = r.DisableDue
+		}
+	}
+	return next
+}
+
+// ClearDisabled forgets that a user was disabled or scheduled to be disabled,
+// if they were.
+func (us *UserState) ClearDisabled(username string) {
+	if us == nil {
+		return
+	}
+	if r, ok := us.Users[username]; ok && (!r.DisabledAt.IsZero() || !r.DisableDue.IsZero() || !r.ExpiredAt.IsZero()) {
+		r.DisabledAt = time.Time{}
+		r.DisableDue = time.Time{}
+		r.DisableReason = ""
+		r.ExpiredAt = time.Time{}
+		us.dirty = true
+	}
+}
+
+// OverrideUsed reports whether the blast radius override key has already let
+// a run through at this ModifyIndex.
+func (us *UserState) OverrideUsed(modifyIndex uint64) bool {
+	return us != nil && us.OverrideIndex == modifyIndex
+}
+
+// UseOverride remembers that the blast radius override key let a run through
+// at this ModifyIndex.
+func (us *UserState) UseOverride(modifyIndex uint64) {
+	if us == nil || us.OverrideIndex == modifyIndex {
+		return
+	}
+	us.OverrideIndex = modifyIndex
+	us.dirty = true
+}
+
+// Remove forgets everything about a user, as when they've been deleted.
+func (us *UserState) Remove(username string) {
+	if us == nil {
+		return
+	}
+	if _, ok := us.Users[username]; ok {
+		delete(us.Users, username)
+		us.dirty = true
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"fmt"
+	"github.com/tideland/golib/logger"
+	"time"
+)
+
+// InactiveReason is recorded as the reason a user was disabled when they
+// hadn't logged in for too long.
+const InactiveReason = "inactive"
+
+// checkActivity logs when each existing user last logged in, and marks users
+// who haven't logged in for longer than their groups allow to be disabled.
+// How long a user has gone without logging in is counted from the later of
+// their last login, when their password was last changed (which for most
+// accounts managed by spqr is when they were created), and when they were
+// reactivated according to their user definition. Nobody logs in to a root
+// directory other than "/", so it's skipped there.
+func checkActivity(userList []*User, now time.Time) {
+	if altRoot() {
+		return
+	}
+	var history *loginHistory
+
+	for _, u := range userList {
+		if u.notExist || u.Action == Delete {
+			continue
+		}
+		if history == nil {
+			history = loadLoginHistory()
+		}
+
+		last, from := history.lastLogin(u)
+		if last.IsZero() {
+			logger.Infof("Last login for %s: never", u.Username)
+		} else {
+			logger.Infof("Last login for %s: %s (%s)", u.Username, last.Format(time.RFC3339), from)
+		}
+
+		if u.inactiveDays <= 0 || u.Action == Disable {
+			continue
+		}
+
+		since := last
+		if pc, err := passwordChanged(u.Username); err != nil {
+			logger.Debugf("could not tell when %s's password was last changed: %s", u.Username, err.Error())
+		} else if pc.After(since) {
+			since = pc
+		}
+		if u.reactivatedAt.After(since) {
+			since = u.reactivatedAt
+		}
+		if since.IsZero() {
+			logger.Warningf("Can't tell how long %s has been inactive, so not disabling them", u.Username)
+			continue
+		}
+
+		limit := time.Duration(u.inactiveDays) * 24 * time.Hour
+		if now.Sub(since) > limit {
+			logger.Infof("%s has been inactive since %s, more than %d days; disabling them", u.Username, since.Format(time.RFC3339), u.inactiveDays)
+			u.Action = Disable
+			u.disableReason = InactiveReason
+		}
+	}
+}
+
+// parseReactivated parses the date a user was reactivated, which may be a
+// date like "2018-06-01" or an RFC 3339 timestamp.
+func parseReactivated(r string) (time.Time, error) {
+	if r == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", r); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, r)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse reactivated_at '%s': it should be a date like 2018-06-01 or an RFC 3339 timestamp", r)
+	}
+	return t, nil
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NoExpiry is the value shadow uses for an account expiry date, or an aging
+// setting, that isn't set.
+const NoExpiry = -1
+
+const secondsPerDay = 24 * 60 * 60
+
+// PasswordAging holds the password aging settings from a user definition.
+type PasswordAging struct {
+	MaxDays      *int `json:"max_days"`
+	WarnDays     *int `json:"warn_days"`
+	InactiveDays *int `json:"inactive_days"`
+}
+
+// Aging is an account's expiry date and password aging settings, in the form
+// they're kept in /etc/shadow. Fields left nil aren't managed.
+type Aging struct {
+	// Expires is the account expiry date in days since the epoch, or
+	// NoExpiry.
+	Expires      *int
+	MaxDays      *int
+	WarnDays     *int
+	InactiveDays *int
+}
+
+// aging works out the account aging settings the user definition asks for.
+// The expiry date may be a date like "2018-12-31", an RFC 3339 timestamp, or
+// "never" to remove an existing expiry date.
+func (ui *UserInfo) aging() (*Aging, error) {
+	if ui.ExpiresAt == "" && ui.PasswordAging == nil {
+		return nil, nil
+	}
+	a := new(Aging)
+
+	if ui.ExpiresAt != "" {
+		days, err := parseExpiry(ui.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse expires_at '%s' for %s: %s", ui.ExpiresAt, ui.Username, err.Error())
+		}
+		a.Expires = &days
+	}
+
+	if pa := ui.PasswordAging; pa != nil {
+		a.MaxDays = pa.MaxDays
+		a.WarnDays = pa.WarnDays
+		a.InactiveDays = pa.InactiveDays
+	}
+
+	return a, nil
+}
+
+func parseExpiry(e string) (int, error) {
+	if strings.ToLower(e) == "never" {
+		return NoExpiry, nil
+	}
+	t, err := time.Parse("2006-01-02", e)
+	if err != nil {
+		var rerr error
+		if t, rerr = time.Parse(time.RFC3339, e); rerr != nil {
+			return 0, err
+		}
+	}
+	return int(t.Unix() / secondsPerDay), nil
+}
+
+// diff returns the settings in a that don't match cur, or nil if everything
+// matches.
+func (a *Aging) diff(cur *Aging) *Aging {
+	if a == nil {
+		return nil
+	}
+	if cur == nil {
+		cur = new(Aging)
+	}
+
+	d := new(Aging)
+	var changed bool
+	for _, f := range []struct {
+		want, have *int
+		dst        **int
+	}{
+		{a.Expires, cur.Expires, &d.Expires},
+		{a.MaxDays, cur.MaxDays, &d.MaxDays},
+		{a.WarnDays, cur.WarnDays, &d.WarnDays},
+		{a.InactiveDays, cur.InactiveDays, &d.InactiveDays},
+	} {
+		if f.want == nil {
+			continue
+		}
+		if f.have == nil || *f.have != *f.want {
+			*f.dst = f.want
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return d
+}
+
+func (a *Aging) String() string {
+	if a == nil {
+		return "none"
+	}
+	var parts []string
+	show := func(name string, v *int) {
+		if v != nil {
+			parts = append(parts, fmt.Sprintf("%s %d", name, *v))
+		}
+	}
+	if a.Expires != nil {
+		if *a.Expires == NoExpiry {
+			parts = append(parts, "expires never")
+		} else {
+			parts = append(parts, fmt.Sprintf("expires %s", expiryDate(*a.Expires)))
+		}
+	}
+	show("max days", a.MaxDays)
+	show("warn days", a.WarnDays)
+	show("inactive days", a.InactiveDays)
+	return strings.Join(parts, ", ")
+}
+
+func expiryDate(days int) string {
+	return time.Unix(int64(days)*secondsPerDay, 0).UTC().Format("2006-01-02")
+}
+
+// agingFromShadow pulls the account expiry date and password aging settings
+// out of the fields of an /etc/shadow entry.
+func agingFromShadow(fields []string) *Aging {
+	// name:password:lastchg:min:max:warn:inactive:expire:reserved
+	a := new(Aging)
+	a.MaxDays = shadowField(fields[4])
+	a.WarnDays = shadowField(fields[5])
+	a.InactiveDays = shadowField(fields[6])
+	a.Expires = shadowField(fields[7])
+	return a
+}
+
+// lastChangeFromShadow returns when the password was last changed according to
+// the fields of an /etc/shadow entry, or the zero time if it isn't set.
+func lastChangeFromShadow(fields []string) time.Time {
+	lastchg := shadowField(fields[2])
+	if *lastchg <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(*lastchg)*secondsPerDay, 0)
+}
+
+func shadowField(f string) *int {
+	v := NoExpiry
+	if f != "" {
+		if n, err := strconv.Atoi(f); err == nil {
+			v = n
+		}
+	}
+	return &v
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/tideland/golib/logger"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const archiveDirPerm = 0700
+const archivePerm = 0600
+
+// ArchiveManifest describes a home directory archive made before a user was
+// deleted. It's written alongside the archive itself.
+type ArchiveManifest struct {
+	Username   string          `json:"username"`
+	Uid        string          `json:"uid"`
+	Gid        string          `json:"gid"`
+	HomeDir    string          `json:"home_dir"`
+	ArchivedAt time.Time       `json:"archived_at"`
+	Archive    string          `json:"archive"`
+	SHA256     string          `json:"sha256"`
+	TotalBytes int64           `json:"total_bytes"`
+	Files      []*ArchivedFile `json:"files"`
+}
+
+// ArchivedFile is a single entry in a home directory archive.
+type ArchivedFile struct {
+	Path   string      `json:"path"`
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256,omitempty"`
+}
+
+// archiveHome writes the user's home directory to a gzipped tarball in
+// archiveDir, along with a JSON manifest of what's in it. It returns the path
+// to the archive, or an empty string if there was no home directory to
+// archive.
+func (u *User) archiveHome(archiveDir string) (string, error) {
+	if u.HomeDir == "" {
+		return "", nil
+	}
+	if fi, err := os.Lstat(rootPath(u.HomeDir)); err != nil {
+		if os.IsNotExist(err) {
+			logger.Infof("home directory %s for %s doesn't exist, nothing to archive", u.HomeDir, u.Username)
+			return "", nil
+		}
+		return "", err
+	} else if !fi.IsDir() {
+		return "", fmt.Errorf("home directory %s for %s is not a directory", u.HomeDir, u.Username)
+	}
+
+	if err := os.MkdirAll(archiveDir, archiveDirPerm); err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	base := fmt.Sprintf("%s-%s", u.Username, now.Format("20060102150405"))
+	archivePath := path.Join(archiveDir, base+".tar.gz")
+	manifestPath := path.Join(archiveDir, base+".manifest.json")
+
+	manifest := &ArchiveManifest{Username: u.Username, Uid: u.Uid, Gid: u.Gid, HomeDir: u.HomeDir, ArchivedAt: now, Archive: archivePath}
+
+	sum, err := writeArchive(archivePath, rootPath(u.HomeDir), manifest)
+	if err != nil {
+		os.Remove(archivePath)
+		return "", err
+	}
+	manifest.SHA256 = sum
+
+	mraw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	mf, err := os.OpenFile(manifestPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, archivePerm)
+	if err != nil {
+		return "", err
+	}
+	if _, err = mf.Write(mraw); err != nil {
+		mf.Close()
+		return "", err
+	}
+	if err = mf.Close(); err != nil {
+		return "", err
+	}
+
+	logger.Infof("Archived home directory %s for %s to %s (%d files, %d bytes)", u.HomeDir, u.Username, archivePath, len(manifest.Files), manifest.TotalBytes)
+	return archivePath, nil
+}
+
+// writeArchive tars and gzips everything under homeDir into archivePath,
+// filling in the manifest's file list as it goes. It returns the SHA256 sum
+// of the finished archive.
+func writeArchive(archivePath string, homeDir string, manifest *ArchiveManifest) (string, error) {
+	af, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, archivePerm)
+	if err != nil {
+		return "", err
+	}
+	defer af.Close()
+
+	archiveSum := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(af, archiveSum))
+	tw := tar.NewWriter(gz)
+
+	topDir := path.Base(homeDir)
+	err = filepath.Walk(homeDir, func(p string, fi os.FileInfo, werr error) error {
+		if werr != nil {
+			return werr
+		}
+		// tar can't hold sockets, and they're useless once the
+		// process listening on them is gone anyway.
+		if fi.Mode()&os.ModeSocket != 0 {
+			logger.Debugf("skipping socket %s while archiving %s", p, homeDir)
+			return nil
+		}
+		rel, err := filepath.Rel(homeDir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(topDir, filepath.ToSlash(rel))
+
+		// The home directory belongs to the user, so anything in it
+		// may have been swapped for something else since it was
+		// walked. Regular files are opened without following symlinks
+		// and checked again before anything is read from them.
+		var f *os.File
+		if fi.Mode().IsRegular() {
+			if f, fi, err = openArchivable(p, fi); err != nil {
+				return err
+			}
+			defer f.Close()
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() && !strings.HasSuffix(hdr.Name, "/") {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		entry := &ArchivedFile{Path: name, Mode: fi.Mode()}
+		if f != nil {
+			fileSum := sha256.New()
+			n, err := io.Copy(io.MultiWriter(tw, fileSum), io.LimitReader(f, hdr.Size))
+			if err != nil {
+				return err
+			}
+			entry.Size = n
+			entry.SHA256 = hex.EncodeToString(fileSum.Sum(nil))
+			manifest.TotalBytes += n
+		}
+		manifest.Files = append(manifest.Files, entry)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err = tw.Close(); err != nil {
+		return "", err
+	}
+	if err = gz.Close(); err != nil {
+		return "", err
+	}
+	if err = af.Sync(); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(archiveSum.Sum(nil)), nil
+}
+
+// openArchivable opens a file found while walking a home directory, making
+// sure it's still the same regular file it was when it was walked. Symlinks
+// aren't followed, and opening a FIFO doesn't block. The file's info as of
+// when it was opened is returned along with it.
+func openArchivable(p string, walked os.FileInfo) (*os.File, os.FileInfo, error) {
+	f, err := os.OpenFile(p, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !fi.Mode().IsRegular() || !os.SameFile(walked, fi) {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s changed while it was being archived", p)
+	}
+	return f, fi, nil
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"fmt"
+	"github.com/tideland/golib/logger"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultBackend is the account backend used unless another one is chosen.
+// If shadow-utils isn't installed but BusyBox's adduser is, BusyBoxBackend is
+// used instead.
+const DefaultBackend = "shadow-utils"
+
+// BusyBoxBackend is the name of the backend that manages accounts with the
+// BusyBox applets found on Alpine and other small distributions.
+const BusyBoxBackend = "busybox"
+
+// Backend creates, modifies, locks, and looks up OS accounts and groups.
+// Everything spqr does to an account goes through one, so different ways of
+// managing accounts can be swapped in without touching the rest of spqr.
+type Backend interface {
+	// Name returns the name the backend is chosen by.
+	Name() string
+	// LookupUser returns the named account. If there's no such account
+	// it returns a user.UnknownUserError.
+	LookupUser(username string) (*Account, error)
+	// CreateUser creates a new account, along with its home directory if
+	// createHome is set. If the account has no primary group, a group
+	// with the same name as the user is created for it.
+	CreateUser(a *Account, createHome bool) error
+	// ModifyUser changes an existing account.
+	ModifyUser(username string, c *AccountChanges) error
+	// DeleteUser removes an account, along with its home directory and
+	// mail spool if removeHome is set.
+	DeleteUser(username string, removeHome bool) error
+	// LockUser locks or unlocks an account's password.
+	LockUser(username string, lock bool) error
+	// GroupExists checks if the named group exists.
+	GroupExists(name string) (bool, error)
+	// CreateGroup creates a new, empty group.
+	CreateGroup(name string) error
+	// GetAging returns the account's expiry date and password aging
+	// settings.
+	GetAging(username string) (*Aging, error)
+	// SetAging changes the account's expiry date and password aging
+	// settings. Settings left nil are left alone.
+	SetAging(username string, a *Aging) error
+	// PasswordChanged returns when the account's password was last
+	// changed, or the zero time if that isn't known.
+	PasswordChanged(username string) (time.Time, error)
+	// PasswordLocked checks if the account has a password that's been
+	// locked.
+	PasswordLocked(username string) (bool, error)
+}
+
+// Account is an OS account as a backend sees it.
+type Account struct {
+	Username     string
+	Uid          string
+	Gid          string
+	Name         string
+	HomeDir      string
+	Shell        string
+	PrimaryGroup string
+	// Groups are the account's secondary groups, not including its
+	// primary group.
+	Groups []string
+}
+
+// AccountChanges are the changes to make to an account. Empty fields are left
+// alone. Groups replaces the account's secondary groups if it isn't nil, so an
+// empty, non-nil slice removes the account from all of its secondary groups.
+type AccountChanges struct {
+	Name         string
+	HomeDir      string
+	Shell        string
+	PrimaryGroup string
+	Groups       []string
+}
+
+var backendFuncs = make(map[string]func(root string) (Backend, error))
+
+// registerBackend makes a backend available to NewBackend under the given
+// name. The function setting the backend up is given the root directory to
+// manage accounts under.
+func registerBackend(name string, f func(root string) (Backend, error)) {
+	backendFuncs[name] = f
+}
+
+// BackendNames returns the names of the available backends.
+func BackendNames() []string {
+	names := make([]string, 0, len(backendFuncs))
+	for n := range backendFuncs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend sets up the backend with the given name, managing the accounts
+// under the root directory set with SetRoot. If the name is empty, it picks a
+// backend based on which tools are installed.
+func NewBackend(name string) (Backend, error) {
+	if name == "" {
+		name = detectBackend()
+	}
+	f, ok := backendFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown account backend '%s', the available backends are: %s", name, strings.Join(BackendNames(), ", "))
+	}
+	return f(rootDir)
+}
+
+// detectBackend picks the default backend, unless shadow-utils is missing and
+// BusyBox is there to take its place.
+func detectBackend() string {
+	if _, err := exec.LookPath("useradd"); err == nil {
+		return DefaultBackend
+	}
+	if _, ok := backendFuncs[BusyBoxBackend]; !ok {
+		return DefaultBackend
+	}
+	if _, err := exec.LookPath("adduser"); err != nil {
+		return DefaultBackend
+	}
+	return BusyBoxBackend
+}
+
+var backend Backend
+
+var rootDir = "/"
+
+// SetRoot makes spqr manage the users in the filesystem tree under dir, like a
+// chroot, container root filesystem, or mounted disk image, rather than the
+// ones on the running system. It needs to be called before NewBackend.
+func SetRoot(dir string) {
+	if dir == "" {
+		dir = "/"
+	}
+	rootDir = filepath.Clean(dir)
+	if altRoot() {
+		logger.Infof("Managing the users under %s rather than this machine's", rootDir)
+	}
+}
+
+// altRoot is true when spqr is managing users under a root directory other
+// than "/". Nobody can be logged in or running anything there, so there are no
+// processes to kill, sessions to warn, or logins to check.
+func altRoot() bool {
+	return rootDir != "/"
+}
+
+// rootPath returns where p is under the root directory.
+func rootPath(p string) string {
+	return filepath.Join(rootDir, p)
+}
+
+// SetBackend sets the backend used to manage accounts.
+func SetBackend(b Backend) {
+	backend = b
+}
+
+func currentBackend() Backend {
+	if backend == nil {
+		b, err := NewBackend("")
+		if err != nil {
+			b = &unsupportedBackend{err}
+		}
+		backend = b
+	}
+	return backend
+}
+
+// unsupportedBackend is used when no backend can be set up, like on platforms
+// spqr doesn't support yet. Everything it's asked to do fails.
+type unsupportedBackend struct {
+	err error
+}
+
+func (b *unsupportedBackend) Name() string {
+	return "unsupported"
+}
+
+func (b *unsupportedBackend) LookupUser(username string) (*Account, error) {
+	return nil, b.err
+}
+
+func (b *unsupportedBackend) CreateUser(a *Account, createHome bool) error {
+	return b.err
+}
+
+func (b *unsupportedBackend) ModifyUser(username string, c *AccountChanges) error {
+	return b.err
+}
+
+func (b *unsupportedBackend) DeleteUser(username string, removeHome bool) error {
+	return b.err
+}
+
+func (b *unsupportedBackend) LockUser(username string, lock bool) error {
+	return b.err
+}
+
+func (b *unsupportedBackend) GroupExists(name string) (bool, error) {
+	return false, b.err
+}
+
+func (b *unsupportedBackend) CreateGroup(name string) error {
+	return b.err
+}
+
+func (b *unsupportedBackend) GetAging(username string) (*Aging, error) {
+	return nil, b.err
+}
+
+func (b *unsupportedBackend) SetAging(username string, a *Aging) error {
+	return b.err
+}
+
+func (b *unsupportedBackend) PasswordChanged(username string) (time.Time, error) {
+	return time.Time{}, b.err
+}
+
+func (b *unsupportedBackend) PasswordLocked(username string) (bool, error) {
+	return false, b.err
+}
@@ -0,0 +1,184 @@
+// +build linux
+
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"fmt"
+	"github.com/tideland/golib/logger"
+	"strings"
+)
+
+func init() {
+	registerBackend(BusyBoxBackend, func(root string) (Backend, error) {
+		if root != "/" {
+			return nil, fmt.Errorf("BusyBox can't manage accounts under another root directory like %s; use the %s backend instead", root, FilesBackend)
+		}
+		return &busyBox{newFilesBackend(root)}, nil
+	})
+}
+
+// busyBox manages accounts with the adduser, deluser, addgroup, delgroup, and
+// passwd applets from BusyBox, for hosts like Alpine that don't have
+// shadow-utils. BusyBox has no usermod or chage, so changes to the account
+// fields and account aging are made by editing the files directly, the same
+// way the files backend does, and group memberships are worked out here and
+// changed one at a time with addgroup and delgroup.
+type busyBox struct {
+	*filesBackend
+}
+
+func (b *busyBox) Name() string {
+	return BusyBoxBackend
+}
+
+func (b *busyBox) CreateUser(a *Account, createHome bool) error {
+	// -D keeps adduser from prompting for a password; the account is
+	// left locked instead.
+	adduserArgs := []string{"-D", "-s", a.Shell}
+
+	if !createHome {
+		adduserArgs = append(adduserArgs, "-H")
+	}
+	if a.Name != "" {
+		adduserArgs = append(adduserArgs, "-g", a.Name)
+	}
+	// Without -G adduser makes a group with the same name as the user.
+	if a.PrimaryGroup != "" {
+		adduserArgs = append(adduserArgs, "-G", a.PrimaryGroup)
+	}
+	if a.HomeDir != "" {
+		adduserArgs = append(adduserArgs, "-h", a.HomeDir)
+	}
+	if a.Uid != "" {
+		adduserArgs = append(adduserArgs, "-u", a.Uid)
+	}
+	adduserArgs = append(adduserArgs, a.Username)
+
+	if err := runCommand("adduser", adduserArgs...); err != nil {
+		return fmt.Errorf("Error received while trying to create user: %s", err.Error())
+	}
+
+	for _, g := range a.Groups {
+		if err := b.addToGroup(a.Username, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *busyBox) ModifyUser(username string, c *AccountChanges) error {
+	if c.Name != "" || c.HomeDir != "" || c.Shell != "" || c.PrimaryGroup != "" {
+		fieldChanges := &AccountChanges{Name: c.Name, HomeDir: c.HomeDir, Shell: c.Shell, PrimaryGroup: c.PrimaryGroup}
+		if err := b.filesBackend.ModifyUser(username, fieldChanges); err != nil {
+			return fmt.Errorf("Error received while modifying %s: %s", username, err.Error())
+		}
+	}
+	if c.Groups == nil {
+		return nil
+	}
+
+	a, err := b.LookupUser(username)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]bool, len(c.Groups))
+	for _, g := range c.Groups {
+		want[g] = true
+	}
+	have := make(map[string]bool, len(a.Groups))
+	for _, g := range a.Groups {
+		have[g] = true
+		if !want[g] {
+			if err := b.removeFromGroup(username, g); err != nil {
+				return err
+			}
+		}
+	}
+	for _, g := range c.Groups {
+		if !have[g] {
+			if err := b.addToGroup(username, g); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *busyBox) DeleteUser(username string, removeHome bool) error {
+	var deluserArgs []string
+	if removeHome {
+		deluserArgs = append(deluserArgs, "--remove-home")
+	}
+	deluserArgs = append(deluserArgs, username)
+
+	if err := runCommand("deluser", deluserArgs...); err != nil {
+		return fmt.Errorf("Error received while deleting user %s: %s", username, err.Error())
+	}
+	return nil
+}
+
+func (b *busyBox) LockUser(username string, lock bool) error {
+	op := "-l"
+	if !lock {
+		// BusyBox's passwd -u will cheerfully strip the '!' off of an
+		// account that never had a password, leaving it with an empty
+		// one, so check for that first.
+		dbs, err := b.read()
+		if err != nil {
+			return err
+		}
+		sh := dbs.shadow.find(username)
+		if sh == nil {
+			return fmt.Errorf("no shadow entry found for %s", username)
+		}
+		if unlocked := strings.TrimLeft(sh[1], lockedPassword); unlocked == "" || unlocked == "*" || unlocked == sh[1] {
+			logger.Debugf("not unlocking %s, who has no password to unlock", username)
+			return nil
+		}
+		op = "-u"
+	}
+
+	if err := runCommand("passwd", op, username); err != nil {
+		return fmt.Errorf("Error received while locking/unlocking account %s: %s", username, err.Error())
+	}
+	return nil
+}
+
+func (b *busyBox) CreateGroup(name string) error {
+	if err := runCommand("addgroup", name); err != nil {
+		return fmt.Errorf("Error received trying to create group %s: %s", name, err.Error())
+	}
+	return nil
+}
+
+func (b *busyBox) addToGroup(username string, group string) error {
+	logger.Debugf("adding %s to group %s", username, group)
+	if err := runCommand("addgroup", username, group); err != nil {
+		return fmt.Errorf("Error received adding %s to group %s: %s", username, group, err.Error())
+	}
+	return nil
+}
+
+func (b *busyBox) removeFromGroup(username string, group string) error {
+	logger.Debugf("removing %s from group %s", username, group)
+	if err := runCommand("delgroup", username, group); err != nil {
+		return fmt.Errorf("Error received removing %s from group %s: %s", username, group, err.Error())
+	}
+	return nil
+}
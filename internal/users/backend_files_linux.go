@@ -0,0 +1,911 @@
+// +build linux
+
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"fmt"
+	"github.com/tideland/golib/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FilesBackend is the name of the backend that edits /etc/passwd, /etc/group,
+// /etc/shadow, and /etc/gshadow directly, without needing shadow-utils.
+const FilesBackend = "files"
+
+// lckpwdf(3) waits this long for the lock before giving up.
+const pwdLockTimeout = 15 * time.Second
+
+const (
+	homeDirPerm    = 0700
+	defaultGidMin  = 1000
+	defaultGidMax  = 60000
+	lockedPassword = "!"
+)
+
+// ExtraUsersBackend is the name of the backend that keeps spqr's users and
+// groups in libnss-extrausers' own account files, apart from the local ones.
+const ExtraUsersBackend = "extrausers"
+
+// ExtraUsersDir is where libnss-extrausers looks for its account files.
+const ExtraUsersDir = "/var/lib/extrausers"
+
+func init() {
+	registerBackend(FilesBackend, func(root string) (Backend, error) { return newFilesBackend(root), nil })
+	registerBackend(ExtraUsersBackend, func(root string) (Backend, error) { return newExtraUsersBackend(root), nil })
+}
+
+// filesBackend manages accounts by editing the account databases itself. Every
+// change takes the same lock lckpwdf(3) does, so it plays nicely with
+// shadow-utils and anything else that edits the files, and each file is
+// replaced atomically with the old version kept as a backup, the same way
+// shadow-utils does it (e.g. /etc/passwd- for /etc/passwd).
+//
+// The extrausers backend is a filesBackend too, one that works on the files in
+// /var/lib/extrausers instead. The local account files are then only read, to
+// keep the two from clashing.
+type filesBackend struct {
+	name  string
+	root  string
+	dir   string
+	local *filesBackend
+}
+
+func newFilesBackend(root string) *filesBackend {
+	return &filesBackend{name: FilesBackend, root: root, dir: "/etc"}
+}
+
+func newExtraUsersBackend(root string) *filesBackend {
+	f := &filesBackend{name: ExtraUsersBackend, root: root, dir: ExtraUsersDir, local: newFilesBackend(root)}
+	if !nsswitchHas(f.path("/etc/nsswitch.conf"), "extrausers") {
+		logger.Warningf("extrausers isn't set up in /etc/nsswitch.conf, so the users spqr manages won't be visible to the rest of the system")
+	}
+	return f
+}
+
+// accountDB is one of the colon separated account databases. Every line is
+// kept, split on colons, so the file can be written back out exactly as it was
+// apart from whatever was changed.
+type accountDB struct {
+	path    string
+	lines   [][]string
+	missing bool
+	changed bool
+	// newMode is the mode the file is created with if it doesn't exist
+	// yet. If it's zero, a missing file is left missing.
+	newMode os.FileMode
+}
+
+// accountDBs are all the account databases, read in and locked for changes.
+type accountDBs struct {
+	passwd  *accountDB
+	group   *accountDB
+	shadow  *accountDB
+	gshadow *accountDB
+	// local are the local account databases, when these ones are kept
+	// apart from them.
+	local *accountDBs
+}
+
+func (f *filesBackend) Name() string {
+	return f.name
+}
+
+func (f *filesBackend) path(p string) string {
+	return filepath.Join(f.root, p)
+}
+
+func (f *filesBackend) dbPath(name string) string {
+	return filepath.Join(f.root, f.dir, name)
+}
+
+func (f *filesBackend) LookupUser(username string) (*Account, error) {
+	dbs, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return dbs.lookupUser(username)
+}
+
+func (f *filesBackend) CreateUser(a *Account, createHome bool) error {
+	var home string
+	var homeUid, homeGid int
+	err := f.change(func(dbs *accountDBs) error {
+		if dbs.passwd.find(a.Username) != nil {
+			return fmt.Errorf("user %s already exists", a.Username)
+		}
+		if dbs.local != nil {
+			if dbs.local.passwd.find(a.Username) != nil {
+				return fmt.Errorf("user %s already exists in %s", a.Username, dbs.local.passwd.path)
+			}
+			if a.Uid == "" {
+				return fmt.Errorf("no uid was given for %s, and the %s backend needs every user definition to have one", a.Username, f.name)
+			}
+		}
+		uidMin, uidMax := defaultUidMin, defaultUidMax
+		gidMin, gidMax := defaultGidMin, defaultGidMax
+		if err := readLoginDefs(f.path(LoginDefs), map[string]*int{"UID_MIN": &uidMin, "UID_MAX": &uidMax, "GID_MIN": &gidMin, "GID_MAX": &gidMax}); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		uid := a.Uid
+		if uid == "" {
+			n, err := freeId(2, uidMin, uidMax, dbs.passwdDBs()...)
+			if err != nil {
+				return err
+			}
+			uid = strconv.Itoa(n)
+		} else if dbs.findUid(uid) != nil {
+			return fmt.Errorf("uid %s is already taken", uid)
+		}
+
+		var gid string
+		if a.PrimaryGroup != "" {
+			g := dbs.findGroup(a.PrimaryGroup)
+			if g == nil {
+				return fmt.Errorf("primary group %s for %s does not exist", a.PrimaryGroup, a.Username)
+			}
+			gid = g[2]
+		} else {
+			// like useradd -U, give the user a group of their own,
+			// with the same id as their uid if it's free.
+			if dbs.findGroup(a.Username) != nil {
+				return fmt.Errorf("group %s already exists; give %s a primary group instead", a.Username, a.Username)
+			}
+			gid = uid
+			if dbs.findGid(gid) != nil {
+				n, err := freeId(2, gidMin, gidMax, dbs.groupDBs()...)
+				if err != nil {
+					return err
+				}
+				gid = strconv.Itoa(n)
+			}
+			dbs.addGroup(a.Username, gid)
+		}
+
+		home = a.HomeDir
+		if home == "" {
+			home = path.Join(DefaultHomeBase, a.Username)
+		}
+		dbs.passwd.add([]string{a.Username, "x", uid, gid, a.Name, home, a.Shell})
+		dbs.shadow.add([]string{a.Username, lockedPassword, strconv.Itoa(today()), "", "", "", "", "", ""})
+		for _, g := range a.Groups {
+			if err := dbs.addMember(g, a.Username); err != nil {
+				return err
+			}
+		}
+
+		logger.Debugf("created user %s with uid %s and gid %s", a.Username, uid, gid)
+		homeUid, _ = strconv.Atoi(uid)
+		homeGid, _ = strconv.Atoi(gid)
+		return nil
+	})
+	if err != nil || !createHome {
+		return err
+	}
+
+	// The home directory is only made once the user has been written to
+	// the account databases, so a failed write can't leave one behind
+	// owned by a uid that's free to be given to someone else.
+	return f.makeHome(home, homeUid, homeGid)
+}
+
+func (f *filesBackend) ModifyUser(username string, c *AccountChanges) error {
+	return f.change(func(dbs *accountDBs) error {
+		pw := dbs.passwd.find(username)
+		if pw == nil {
+			return user.UnknownUserError(username)
+		}
+		if c.Name != "" {
+			pw[4] = c.Name
+		}
+		if c.HomeDir != "" {
+			pw[5] = c.HomeDir
+		}
+		if c.Shell != "" {
+			pw[6] = c.Shell
+		}
+		if c.PrimaryGroup != "" {
+			g := dbs.findGroup(c.PrimaryGroup)
+			if g == nil {
+				return fmt.Errorf("group %s does not exist", c.PrimaryGroup)
+			}
+			pw[3] = g[2]
+		}
+		dbs.passwd.changed = true
+
+		if c.Groups != nil {
+			want := make(map[string]bool, len(c.Groups))
+			for _, g := range c.Groups {
+				if dbs.findGroup(g) == nil {
+					return fmt.Errorf("group %s does not exist", g)
+				}
+				want[g] = true
+			}
+			for _, g := range dbs.group.lines {
+				if len(g) < 4 || want[g[0]] {
+					continue
+				}
+				dbs.removeMember(g[0], username)
+			}
+			for _, g := range c.Groups {
+				if err := dbs.addMember(g, username); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (f *filesBackend) DeleteUser(username string, removeHome bool) error {
+	var home string
+	err := f.change(func(dbs *accountDBs) error {
+		pw := dbs.passwd.find(username)
+		if pw == nil {
+			return user.UnknownUserError(username)
+		}
+		home = pw[5]
+		gid := pw[3]
+
+		dbs.passwd.remove(username)
+		dbs.shadow.remove(username)
+		for _, g := range dbs.group.lines {
+			if len(g) >= 4 {
+				dbs.removeMember(g[0], username)
+			}
+		}
+
+		// like userdel, remove the user's own group if nobody else is
+		// using it
+		if g := dbs.group.find(username); g != nil && g[2] == gid && g[3] == "" && dbs.passwd.findField(3, gid) == nil {
+			dbs.group.remove(username)
+			dbs.gshadow.remove(username)
+		}
+		return nil
+	})
+	if err != nil || !removeHome {
+		return err
+	}
+
+	// like userdel -r, only remove the home directory and mail spool
+	// once the user is gone from the account databases
+	if home != "" && home != "/" {
+		if err = os.RemoveAll(f.path(home)); err != nil {
+			return err
+		}
+	}
+	if err = os.Remove(f.path(path.Join("/var/mail", username))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *filesBackend) LockUser(username string, lock bool) error {
+	return f.change(func(dbs *accountDBs) error {
+		sh := dbs.shadow.find(username)
+		if sh == nil {
+			return fmt.Errorf("no shadow entry found for %s", username)
+		}
+		pw := sh[1]
+		if lock {
+			if !strings.HasPrefix(pw, lockedPassword) {
+				sh[1] = lockedPassword + pw
+				dbs.shadow.changed = true
+			}
+			return nil
+		}
+		// Like passwd -u, don't unlock an account that would be left
+		// with no password at all.
+		unlocked := strings.TrimLeft(pw, lockedPassword)
+		if unlocked == "" || unlocked == "*" || unlocked == pw {
+			return nil
+		}
+		sh[1] = unlocked
+		dbs.shadow.changed = true
+		return nil
+	})
+}
+
+func (f *filesBackend) GroupExists(name string) (bool, error) {
+	dbs, err := f.read()
+	if err != nil {
+		return false, err
+	}
+	return dbs.findGroup(name) != nil, nil
+}
+
+func (f *filesBackend) CreateGroup(name string) error {
+	return f.change(func(dbs *accountDBs) error {
+		if dbs.findGroup(name) != nil {
+			return fmt.Errorf("group %s already exists", name)
+		}
+		gidMin, gidMax := defaultGidMin, defaultGidMax
+		if err := readLoginDefs(f.path(LoginDefs), map[string]*int{"GID_MIN": &gidMin, "GID_MAX": &gidMax}); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		gid, err := freeId(2, gidMin, gidMax, dbs.groupDBs()...)
+		if err != nil {
+			return err
+		}
+		dbs.addGroup(name, strconv.Itoa(gid))
+		return nil
+	})
+}
+
+func (f *filesBackend) GetAging(username string) (*Aging, error) {
+	dbs, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	sh := dbs.shadow.find(username)
+	if sh == nil {
+		return nil, fmt.Errorf("no shadow entry found for %s", username)
+	}
+	return agingFromShadow(sh), nil
+}
+
+func (f *filesBackend) SetAging(username string, a *Aging) error {
+	return f.change(func(dbs *accountDBs) error {
+		sh := dbs.shadow.find(username)
+		if sh == nil {
+			return fmt.Errorf("no shadow entry found for %s", username)
+		}
+		for _, s := range []struct {
+			field int
+			val   *int
+		}{
+			{4, a.MaxDays},
+			{5, a.WarnDays},
+			{6, a.InactiveDays},
+			{7, a.Expires},
+		} {
+			if s.val == nil {
+				continue
+			}
+			v := ""
+			if *s.val != NoExpiry {
+				v = strconv.Itoa(*s.val)
+			}
+			sh[s.field] = v
+		}
+		dbs.shadow.changed = true
+		return nil
+	})
+}
+
+func (f *filesBackend) PasswordChanged(username string) (time.Time, error) {
+	dbs, err := f.read()
+	if err != nil {
+		return time.Time{}, err
+	}
+	sh := dbs.shadow.find(username)
+	if sh == nil {
+		return time.Time{}, fmt.Errorf("no shadow entry found for %s", username)
+	}
+	return lastChangeFromShadow(sh), nil
+}
+
+func (f *filesBackend) PasswordLocked(username string) (bool, error) {
+	dbs, err := f.read()
+	if err != nil {
+		return false, err
+	}
+	sh := dbs.shadow.find(username)
+	if sh == nil {
+		return false, fmt.Errorf("no shadow entry found for %s", username)
+	}
+	return lockedFromShadow(sh), nil
+}
+
+// lockedFromShadow checks if the password in the fields of an /etc/shadow
+// entry has been locked. Accounts that have never had a password, like the
+// ones spqr creates, are locked from the start, so only a password hash with
+// a lock in front of it counts.
+func lockedFromShadow(fields []string) bool {
+	if !strings.HasPrefix(fields[1], lockedPassword) {
+		return false
+	}
+	pw := strings.TrimLeft(fields[1], lockedPassword)
+	return pw != "" && pw != "*"
+}
+
+// read reads in all of the account databases.
+func (f *filesBackend) read() (*accountDBs, error) {
+	// The local account files had better be there already, but the
+	// extrausers files are made when they're first needed. There's no
+	// gshadow for extrausers.
+	var passwdMode, shadowMode os.FileMode
+	if f.local != nil {
+		passwdMode, shadowMode = 0644, 0600
+	}
+
+	dbs := new(accountDBs)
+	for _, d := range []struct {
+		dst    **accountDB
+		file   string
+		fields int
+		mode   os.FileMode
+	}{
+		{&dbs.passwd, "passwd", 7, passwdMode},
+		{&dbs.group, "group", 4, passwdMode},
+		{&dbs.shadow, "shadow", 9, shadowMode},
+		{&dbs.gshadow, "gshadow", 4, 0},
+	} {
+		db, err := readAccountDB(f.dbPath(d.file), d.fields, d.mode)
+		if err != nil {
+			return nil, err
+		}
+		*d.dst = db
+	}
+	if dbs.passwd.missing {
+		return nil, fmt.Errorf("%s does not exist", dbs.passwd.path)
+	}
+
+	if f.local != nil {
+		local, err := f.local.read()
+		if err != nil {
+			return nil, err
+		}
+		dbs.local = local
+	}
+	return dbs, nil
+}
+
+// change locks the account databases, reads them in, makes the changes, and
+// writes out whichever databases were changed.
+func (f *filesBackend) change(changeFunc func(dbs *accountDBs) error) error {
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dbs, err := f.read()
+	if err != nil {
+		return err
+	}
+	if err = changeFunc(dbs); err != nil {
+		return err
+	}
+	for _, db := range []*accountDB{dbs.passwd, dbs.group, dbs.shadow, dbs.gshadow} {
+		if err = db.write(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lock takes the same lock on /etc/.pwd.lock that lckpwdf(3) does, waiting for
+// up to 15 seconds like it does. It returns a function to release the lock.
+func (f *filesBackend) lock() (func(), error) {
+	if err := os.MkdirAll(f.dbPath(""), 0755); err != nil {
+		return nil, err
+	}
+	lockPath := f.dbPath(".pwd.lock")
+	lf, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	deadline := time.Now().Add(pwdLockTimeout)
+	for {
+		err = syscall.FcntlFlock(lf.Fd(), syscall.F_SETLK, &lk)
+		if err == nil {
+			break
+		}
+		if (err != syscall.EAGAIN && err != syscall.EACCES) || time.Now().After(deadline) {
+			lf.Close()
+			return nil, fmt.Errorf("could not lock %s: %s", lockPath, err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return func() {
+		lk.Type = syscall.F_UNLCK
+		syscall.FcntlFlock(lf.Fd(), syscall.F_SETLK, &lk)
+		lf.Close()
+	}, nil
+}
+
+// makeHome creates a new home directory, filled in from /etc/skel.
+func (f *filesBackend) makeHome(home string, uid int, gid int) (err error) {
+	homePath := f.path(home)
+	if _, err := os.Stat(homePath); err == nil {
+		logger.Infof("home directory %s already exists, leaving it be", homePath)
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(homePath), 0755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(homePath, homeDirPerm); err != nil {
+		return err
+	}
+	// don't leave a half made home directory behind
+	defer func() {
+		if err != nil {
+			if rerr := os.RemoveAll(homePath); rerr != nil {
+				logger.Warningf("could not clean up home directory %s after failing to make it: %s", homePath, rerr.Error())
+			}
+		}
+	}()
+	if err := os.Lchown(homePath, uid, gid); err != nil {
+		return err
+	}
+
+	skel := f.path("/etc/skel")
+	if _, err := os.Stat(skel); err != nil {
+		return nil
+	}
+	return filepath.Walk(skel, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(skel, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		dst := filepath.Join(homePath, rel)
+		switch {
+		case info.IsDir():
+			err = os.Mkdir(dst, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			var target string
+			if target, err = os.Readlink(p); err == nil {
+				err = os.Symlink(target, dst)
+			}
+		case info.Mode().IsRegular():
+			var contents []byte
+			if contents, err = ioutil.ReadFile(p); err == nil {
+				err = ioutil.WriteFile(dst, contents, info.Mode().Perm())
+			}
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return os.Lchown(dst, uid, gid)
+	})
+}
+
+func (dbs *accountDBs) lookupUser(username string) (*Account, error) {
+	pw := dbs.passwd.find(username)
+	if pw == nil {
+		return nil, user.UnknownUserError(username)
+	}
+	a := &Account{Username: pw[0], Uid: pw[2], Gid: pw[3], Name: pw[4], HomeDir: pw[5], Shell: pw[6]}
+	if g := dbs.findGid(a.Gid); g != nil {
+		a.PrimaryGroup = g[0]
+	}
+	for _, g := range dbs.group.lines {
+		if len(g) < 4 || g[0] == a.PrimaryGroup {
+			continue
+		}
+		for _, m := range strings.Split(g[3], ",") {
+			if m == username {
+				a.Groups = append(a.Groups, g[0])
+				break
+			}
+		}
+	}
+	return a, nil
+}
+
+// findGroup finds a group by name, looking in the local groups too if there
+// are any. The same goes for findGid and findUid.
+func (dbs *accountDBs) findGroup(name string) []string {
+	if g := dbs.group.find(name); g != nil || dbs.local == nil {
+		return g
+	}
+	return dbs.local.group.find(name)
+}
+
+func (dbs *accountDBs) findGid(gid string) []string {
+	if g := dbs.group.findField(2, gid); g != nil || dbs.local == nil {
+		return g
+	}
+	return dbs.local.group.findField(2, gid)
+}
+
+func (dbs *accountDBs) findUid(uid string) []string {
+	if u := dbs.passwd.findField(2, uid); u != nil || dbs.local == nil {
+		return u
+	}
+	return dbs.local.passwd.findField(2, uid)
+}
+
+// passwdDBs and groupDBs return the passwd and group databases new ids have to
+// be unique across.
+func (dbs *accountDBs) passwdDBs() []*accountDB {
+	if dbs.local == nil {
+		return []*accountDB{dbs.passwd}
+	}
+	return []*accountDB{dbs.passwd, dbs.local.passwd}
+}
+
+func (dbs *accountDBs) groupDBs() []*accountDB {
+	if dbs.local == nil {
+		return []*accountDB{dbs.group}
+	}
+	return []*accountDB{dbs.group, dbs.local.group}
+}
+
+func (dbs *accountDBs) addGroup(name string, gid string) {
+	dbs.group.add([]string{name, "x", gid, ""})
+	if !dbs.gshadow.missing {
+		dbs.gshadow.add([]string{name, lockedPassword, "", ""})
+	}
+}
+
+func (dbs *accountDBs) addMember(group string, username string) error {
+	g := dbs.group.find(group)
+	if g == nil {
+		if dbs.local != nil && dbs.local.group.find(group) != nil {
+			logger.Warningf("Not adding %s to %s, which is a local group rather than one spqr manages", username, group)
+			return nil
+		}
+		return fmt.Errorf("group %s does not exist", group)
+	}
+	if addToList(&g[3], username) {
+		dbs.group.changed = true
+	}
+	if gs := dbs.gshadow.find(group); gs != nil && addToList(&gs[3], username) {
+		dbs.gshadow.changed = true
+	}
+	return nil
+}
+
+func (dbs *accountDBs) removeMember(group string, username string) {
+	if g := dbs.group.find(group); g != nil && removeFromList(&g[3], username) {
+		dbs.group.changed = true
+	}
+	if gs := dbs.gshadow.find(group); gs != nil && removeFromList(&gs[3], username) {
+		dbs.gshadow.changed = true
+	}
+}
+
+func addToList(list *string, name string) bool {
+	var members []string
+	if *list != "" {
+		members = strings.Split(*list, ",")
+	}
+	for _, m := range members {
+		if m == name {
+			return false
+		}
+	}
+	*list = strings.Join(append(members, name), ",")
+	return true
+}
+
+func removeFromList(list *string, name string) bool {
+	if *list == "" {
+		return false
+	}
+	members := strings.Split(*list, ",")
+	kept := members[:0]
+	for _, m := range members {
+		if m != name {
+			kept = append(kept, m)
+		}
+	}
+	if len(kept) == len(members) {
+		return false
+	}
+	*list = strings.Join(kept, ",")
+	return true
+}
+
+func readAccountDB(dbPath string, fields int, newMode os.FileMode) (*accountDB, error) {
+	db := &accountDB{path: dbPath, newMode: newMode}
+	contents, err := ioutil.ReadFile(dbPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			db.missing = newMode == 0
+			return db, nil
+		}
+		return nil, err
+	}
+	text := strings.TrimSuffix(string(contents), "\n")
+	if text == "" {
+		return db, nil
+	}
+	for _, l := range strings.Split(text, "\n") {
+		entry := strings.Split(l, ":")
+		// pad out short entries so fields can be set safely, but leave
+		// comments, blank lines, and NIS compat lines alone.
+		if isEntry(entry) {
+			for len(entry) < fields {
+				entry = append(entry, "")
+			}
+		}
+		db.lines = append(db.lines, entry)
+	}
+	return db, nil
+}
+
+func isEntry(entry []string) bool {
+	return len(entry) > 1 && entry[0] != "" && !strings.HasPrefix(entry[0], "#") && !strings.HasPrefix(entry[0], "+") && !strings.HasPrefix(entry[0], "-")
+}
+
+func (db *accountDB) find(name string) []string {
+	return db.findField(0, name)
+}
+
+func (db *accountDB) findField(field int, val string) []string {
+	if db == nil {
+		return nil
+	}
+	for _, l := range db.lines {
+		if isEntry(l) && len(l) > field && l[field] == val {
+			return l
+		}
+	}
+	return nil
+}
+
+// freeId finds the lowest id in the given range that isn't in use in any of the
+// databases.
+func freeId(field int, min int, max int, dbs ...*accountDB) (int, error) {
+	used := make(map[int]bool)
+	for _, db := range dbs {
+		for _, l := range db.lines {
+			if isEntry(l) && len(l) > field {
+				if n, err := strconv.Atoi(l[field]); err == nil {
+					used[n] = true
+				}
+			}
+		}
+	}
+	for i := min; i <= max; i++ {
+		if !used[i] {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no free ids left between %d and %d in %s", min, max, dbs[0].path)
+}
+
+func (db *accountDB) add(entry []string) {
+	if db.missing {
+		return
+	}
+	db.lines = append(db.lines, entry)
+	db.changed = true
+}
+
+func (db *accountDB) remove(name string) {
+	if db == nil {
+		return
+	}
+	for i, l := range db.lines {
+		if isEntry(l) && l[0] == name {
+			db.lines = append(db.lines[:i], db.lines[i+1:]...)
+			db.changed = true
+			return
+		}
+	}
+}
+
+// write writes the database out if it's changed. The new version is written
+// to a temporary file and renamed into place, after the old version has been
+// saved as a backup with a '-' on the end of its name.
+func (db *accountDB) write() error {
+	if db == nil || db.missing || !db.changed {
+		return nil
+	}
+	var buf strings.Builder
+	for _, l := range db.lines {
+		buf.WriteString(strings.Join(l, ":"))
+		buf.WriteString("\n")
+	}
+
+	info, err := os.Stat(db.path)
+	if os.IsNotExist(err) {
+		if err = writeReplace(db.path, []byte(buf.String()), db.newMode, nil); err != nil {
+			return err
+		}
+		db.changed = false
+		logger.Debugf("created %s", db.path)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	st, _ := info.Sys().(*syscall.Stat_t)
+
+	old, err := ioutil.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+	if err = writeReplace(db.path+"-", old, info.Mode().Perm(), st); err != nil {
+		return err
+	}
+	if err = writeReplace(db.path, []byte(buf.String()), info.Mode().Perm(), st); err != nil {
+		return err
+	}
+	db.changed = false
+	logger.Debugf("wrote out %s", db.path)
+	return nil
+}
+
+// writeReplace atomically replaces the file at p with the given contents,
+// mode, and ownership.
+func writeReplace(p string, contents []byte, mode os.FileMode, st *syscall.Stat_t) error {
+	tmp, err := ioutil.TempFile(path.Dir(p), "."+path.Base(p)+".spqr")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	cleanup := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return cleanup(err)
+	}
+	if st != nil {
+		if err = tmp.Chown(int(st.Uid), int(st.Gid)); err != nil {
+			return cleanup(err)
+		}
+	}
+	if _, err = tmp.Write(contents); err != nil {
+		return cleanup(err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, p); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// nsswitchHas checks if the given NSS module is used to look up users in
+// nsswitch.conf.
+func nsswitchHas(nsswitchConf string, module string) bool {
+	contents, err := ioutil.ReadFile(nsswitchConf)
+	if err != nil {
+		return false
+	}
+	for _, l := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 0 || fields[0] != "passwd:" {
+			continue
+		}
+		for _, m := range fields[1:] {
+			if m == module {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,350 @@
+// +build linux darwin
+
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryBackend is the name of the backend that keeps accounts and groups in
+// memory instead of on the system. Nothing it does outlasts the run, so it's
+// only useful for trying out group and user definitions and for tests.
+const MemoryBackend = "memory"
+
+func init() {
+	registerBackend(MemoryBackend, func(root string) (Backend, error) { return newMemoryBackend(), nil })
+}
+
+// memoryBackend keeps accounts and groups in maps. Home directories are still
+// made and removed under the root directory, since ssh keys are written into
+// them, but they aren't chowned to anyone.
+type memoryBackend struct {
+	users  map[string]*memoryAccount
+	groups map[string]*memoryGroup
+	mu     sync.Mutex
+}
+
+type memoryAccount struct {
+	Account
+	// password is the account's password hash, if it has one.
+	password string
+	locked   bool
+	aging    Aging
+	changed  time.Time
+}
+
+type memoryGroup struct {
+	gid     string
+	members map[string]bool
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{users: make(map[string]*memoryAccount), groups: make(map[string]*memoryGroup)}
+}
+
+func (m *memoryBackend) Name() string {
+	return MemoryBackend
+}
+
+func (m *memoryBackend) LookupUser(username string) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ma, ok := m.users[username]
+	if !ok {
+		return nil, user.UnknownUserError(username)
+	}
+	a := ma.Account
+	a.PrimaryGroup = ""
+	a.Groups = nil
+	for name, g := range m.groups {
+		if g.gid == a.Gid && a.PrimaryGroup == "" {
+			a.PrimaryGroup = name
+		}
+		if g.members[username] {
+			a.Groups = append(a.Groups, name)
+		}
+	}
+	sort.Strings(a.Groups)
+	return &a, nil
+}
+
+func (m *memoryBackend) CreateUser(a *Account, createHome bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[a.Username]; ok {
+		return fmt.Errorf("user %s already exists", a.Username)
+	}
+
+	uid := a.Uid
+	if uid == "" {
+		uid = m.freeId(func(id string) bool { return m.findUid(id) != nil })
+	} else if m.findUid(uid) != nil {
+		return fmt.Errorf("uid %s is already taken", uid)
+	}
+
+	var gid string
+	if a.PrimaryGroup != "" {
+		g, ok := m.groups[a.PrimaryGroup]
+		if !ok {
+			return fmt.Errorf("primary group %s for %s does not exist", a.PrimaryGroup, a.Username)
+		}
+		gid = g.gid
+	} else {
+		if _, ok := m.groups[a.Username]; ok {
+			return fmt.Errorf("group %s already exists; give %s a primary group instead", a.Username, a.Username)
+		}
+		gid = uid
+		if m.findGid(gid) != "" {
+			gid = m.freeId(func(id string) bool { return m.findGid(id) != "" })
+		}
+		m.groups[a.Username] = &memoryGroup{gid: gid, members: make(map[string]bool)}
+	}
+	for _, g := range a.Groups {
+		if _, ok := m.groups[g]; !ok {
+			return fmt.Errorf("group %s does not exist", g)
+		}
+	}
+	for _, g := range a.Groups {
+		m.groups[g].members[a.Username] = true
+	}
+
+	home := a.HomeDir
+	if home == "" {
+		home = path.Join(DefaultHomeBase, a.Username)
+	}
+	never := NoExpiry
+	ma := &memoryAccount{
+		Account: Account{Username: a.Username, Uid: uid, Gid: gid, Name: a.Name, HomeDir: home, Shell: a.Shell},
+		aging:   Aging{Expires: &never, MaxDays: &never, WarnDays: &never, InactiveDays: &never},
+		changed: time.Now(),
+	}
+	m.users[a.Username] = ma
+
+	if createHome {
+		if err := os.MkdirAll(rootPath(home), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) ModifyUser(username string, c *AccountChanges) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ma, ok := m.users[username]
+	if !ok {
+		return user.UnknownUserError(username)
+	}
+	if c.PrimaryGroup != "" {
+		g, ok := m.groups[c.PrimaryGroup]
+		if !ok {
+			return fmt.Errorf("group %s does not exist", c.PrimaryGroup)
+		}
+		ma.Gid = g.gid
+	}
+	if c.Groups != nil {
+		for _, g := range c.Groups {
+			if _, ok := m.groups[g]; !ok {
+				return fmt.Errorf("group %s does not exist", g)
+			}
+		}
+		for _, g := range m.groups {
+			delete(g.members, username)
+		}
+		for _, g := range c.Groups {
+			m.groups[g].members[username] = true
+		}
+	}
+	if c.Name != "" {
+		ma.Name = c.Name
+	}
+	if c.HomeDir != "" {
+		ma.HomeDir = c.HomeDir
+	}
+	if c.Shell != "" {
+		ma.Shell = c.Shell
+	}
+	return nil
+}
+
+func (m *memoryBackend) DeleteUser(username string, removeHome bool) error {
+	m.mu.Lock()
+	ma, ok := m.users[username]
+	if !ok {
+		m.mu.Unlock()
+		return user.UnknownUserError(username)
+	}
+	delete(m.users, username)
+	for _, g := range m.groups {
+		delete(g.members, username)
+	}
+	// like userdel, remove the user's own group if nobody else is using it
+	if g, ok := m.groups[username]; ok && g.gid == ma.Gid && len(g.members) == 0 && m.findGidUser(g.gid) == nil {
+		delete(m.groups, username)
+	}
+	m.mu.Unlock()
+
+	if removeHome && ma.HomeDir != "" && ma.HomeDir != "/" {
+		return os.RemoveAll(rootPath(ma.HomeDir))
+	}
+	return nil
+}
+
+func (m *memoryBackend) LockUser(username string, lock bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ma, ok := m.users[username]
+	if !ok {
+		return user.UnknownUserError(username)
+	}
+	ma.locked = lock
+	return nil
+}
+
+func (m *memoryBackend) GroupExists(name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.groups[name]
+	return ok, nil
+}
+
+func (m *memoryBackend) CreateGroup(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.groups[name]; ok {
+		return fmt.Errorf("group %s already exists", name)
+	}
+	gid := m.freeId(func(id string) bool { return m.findGid(id) != "" })
+	m.groups[name] = &memoryGroup{gid: gid, members: make(map[string]bool)}
+	return nil
+}
+
+func (m *memoryBackend) GetAging(username string) (*Aging, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ma, ok := m.users[username]
+	if !ok {
+		return nil, user.UnknownUserError(username)
+	}
+	a := new(Aging)
+	for _, f := range []struct {
+		src *int
+		dst **int
+	}{
+		{ma.aging.Expires, &a.Expires},
+		{ma.aging.MaxDays, &a.MaxDays},
+		{ma.aging.WarnDays, &a.WarnDays},
+		{ma.aging.InactiveDays, &a.InactiveDays},
+	} {
+		v := *f.src
+		*f.dst = &v
+	}
+	return a, nil
+}
+
+func (m *memoryBackend) SetAging(username string, a *Aging) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ma, ok := m.users[username]
+	if !ok {
+		return user.UnknownUserError(username)
+	}
+	for _, f := range []struct {
+		val *int
+		dst **int
+	}{
+		{a.Expires, &ma.aging.Expires},
+		{a.MaxDays, &ma.aging.MaxDays},
+		{a.WarnDays, &ma.aging.WarnDays},
+		{a.InactiveDays, &ma.aging.InactiveDays},
+	} {
+		if f.val == nil {
+			continue
+		}
+		v := *f.val
+		*f.dst = &v
+	}
+	return nil
+}
+
+func (m *memoryBackend) PasswordChanged(username string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ma, ok := m.users[username]
+	if !ok {
+		return time.Time{}, user.UnknownUserError(username)
+	}
+	return ma.changed, nil
+}
+
+// PasswordLocked only counts a lock on an account that has a password, the
+// same as the backends that read /etc/shadow.
+func (m *memoryBackend) PasswordLocked(username string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ma, ok := m.users[username]
+	if !ok {
+		return false, user.UnknownUserError(username)
+	}
+	return ma.locked && ma.password != "", nil
+}
+
+func (m *memoryBackend) findUid(uid string) *memoryAccount {
+	for _, ma := range m.users {
+		if ma.Uid == uid {
+			return ma
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) findGid(gid string) string {
+	for name, g := range m.groups {
+		if g.gid == gid {
+			return name
+		}
+	}
+	return ""
+}
+
+func (m *memoryBackend) findGidUser(gid string) *memoryAccount {
+	for _, ma := range m.users {
+		if ma.Gid == gid {
+			return ma
+		}
+	}
+	return nil
+}
+
+// freeId returns the first id in the range for regular users that isn't
+// taken.
+func (m *memoryBackend) freeId(taken func(id string) bool) string {
+	for n := defaultUidMin; ; n++ {
+		if id := strconv.Itoa(n); !taken(id) {
+			return id
+		}
+	}
+}
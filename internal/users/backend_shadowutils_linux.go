@@ -0,0 +1,349 @@
+// +build linux
+
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ctdk/spqr/internal/command"
+	"github.com/tideland/golib/logger"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShadowUtilsBackend is the name of the backend that manages accounts with the
+// useradd, usermod, groupadd, userdel, chage, and passwd commands from
+// shadow-utils.
+const ShadowUtilsBackend = "shadow-utils"
+
+func init() {
+	registerBackend(ShadowUtilsBackend, func(root string) (Backend, error) {
+		s := &shadowUtils{root: root}
+		if root != "/" {
+			s.files = newFilesBackend(root)
+		}
+		return s, nil
+	})
+}
+
+// shadowUtils manages accounts with shadow-utils. When the accounts are under
+// another root directory the commands are given --root, and the accounts are
+// looked up by reading the files there, since the system's NSS lookups can't
+// see them.
+type shadowUtils struct {
+	root  string
+	files *filesBackend
+}
+
+func (s *shadowUtils) Name() string {
+	return ShadowUtilsBackend
+}
+
+func (s *shadowUtils) LookupUser(username string) (*Account, error) {
+	if s.files != nil {
+		return s.files.LookupUser(username)
+	}
+	osUser, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	a := &Account{Username: osUser.Username, Uid: osUser.Uid, Gid: osUser.Gid, Name: osUser.Name, HomeDir: osUser.HomeDir}
+
+	if a.Shell, err = getShell(username); err != nil {
+		return nil, err
+	}
+
+	pg, err := user.LookupGroupId(osUser.Gid)
+	if err != nil {
+		return nil, err
+	}
+	a.PrimaryGroup = pg.Name
+
+	gids, _ := osUser.GroupIds()
+	for _, g := range gids {
+		gr, gerr := user.LookupGroupId(g)
+		if gerr != nil || gr.Name == a.PrimaryGroup {
+			continue
+		}
+		a.Groups = append(a.Groups, gr.Name)
+	}
+
+	return a, nil
+}
+
+func (s *shadowUtils) CreateUser(a *Account, createHome bool) error {
+	useraddArgs := []string{"-s", a.Shell}
+
+	if createHome {
+		useraddArgs = append(useraddArgs, "-m")
+	} else {
+		useraddArgs = append(useraddArgs, "-M")
+	}
+
+	if a.Name != "" {
+		useraddArgs = append(useraddArgs, []string{"-c", a.Name}...)
+	}
+
+	if len(a.Groups) > 0 {
+		useraddArgs = append(useraddArgs, []string{"-G", strings.Join(a.Groups, ",")}...)
+	}
+
+	// useradd won't take both -U and -g, so only make a group for the user
+	// when no primary group was given.
+	if a.PrimaryGroup != "" {
+		useraddArgs = append(useraddArgs, []string{"-g", a.PrimaryGroup}...)
+	} else {
+		useraddArgs = append(useraddArgs, "-U")
+	}
+
+	if a.HomeDir != "" {
+		useraddArgs = append(useraddArgs, "-d", a.HomeDir)
+	}
+
+	if a.Uid != "" {
+		useraddArgs = append(useraddArgs, "-u", a.Uid)
+	}
+
+	useraddArgs = append(useraddArgs, a.Username)
+
+	if err := runCommand("useradd", s.rootArgs(useraddArgs...)...); err != nil {
+		return fmt.Errorf("Error received while trying to create user: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *shadowUtils) ModifyUser(username string, c *AccountChanges) error {
+	userModArgs := make([]string, 0, 10)
+	if c.Name != "" {
+		userModArgs = append(userModArgs, "-c", c.Name)
+	}
+	if c.HomeDir != "" {
+		userModArgs = append(userModArgs, "-d", c.HomeDir)
+	}
+	if c.Shell != "" {
+		userModArgs = append(userModArgs, "-s", c.Shell)
+	}
+	if c.PrimaryGroup != "" {
+		userModArgs = append(userModArgs, "-g", c.PrimaryGroup)
+	}
+	if c.Groups != nil {
+		userModArgs = append(userModArgs, "-G", strings.Join(c.Groups, ","))
+	}
+	if len(userModArgs) == 0 {
+		return nil
+	}
+	userModArgs = append(userModArgs, username)
+
+	logger.Debugf("running usermod on '%s' with these arguments: %s", username, strings.Join(userModArgs, " "))
+	if err := runCommand("usermod", s.rootArgs(userModArgs...)...); err != nil {
+		return fmt.Errorf("Error received while modifying %s: %s", username, err.Error())
+	}
+	return nil
+}
+
+func (s *shadowUtils) DeleteUser(username string, removeHome bool) error {
+	var userdelArgs []string
+	if removeHome {
+		userdelArgs = append(userdelArgs, "-r")
+	}
+	userdelArgs = append(userdelArgs, username)
+
+	if err := runCommand("userdel", s.rootArgs(userdelArgs...)...); err != nil {
+		return fmt.Errorf("Error received while deleting user %s: %s", username, err.Error())
+	}
+	return nil
+}
+
+func (s *shadowUtils) LockUser(username string, lock bool) error {
+	var op string
+	if lock {
+		op = "-l"
+	} else {
+		op = "-u"
+	}
+
+	r, err := command.Run("passwd", s.rootArgs(op, username)...)
+	if err != nil {
+		if !lock && !strings.Contains(r.Stderr, "passwordless account") {
+			return fmt.Errorf("Error received while locking/unlocking account %s: %s", username, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *shadowUtils) GroupExists(name string) (bool, error) {
+	if s.files != nil {
+		return s.files.GroupExists(name)
+	}
+	if _, err := user.LookupGroup(name); err != nil {
+		if _, ok := err.(user.UnknownGroupError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *shadowUtils) CreateGroup(name string) error {
+	if err := runCommand("groupadd", s.rootArgs(name)...); err != nil {
+		return fmt.Errorf("Error received trying to create group %s: %s", name, err.Error())
+	}
+	return nil
+}
+
+// GetAging reads the user's account expiry date and password aging settings
+// out of /etc/shadow.
+func (s *shadowUtils) GetAging(username string) (*Aging, error) {
+	if s.files != nil {
+		return s.files.GetAging(username)
+	}
+	fields, err := shadowEntry(username)
+	if err != nil {
+		return nil, err
+	}
+	return agingFromShadow(fields), nil
+}
+
+// SetAging sets the account expiry date and password aging settings with
+// chage.
+func (s *shadowUtils) SetAging(username string, a *Aging) error {
+	chageArgs := make([]string, 0, 9)
+	if a.Expires != nil {
+		exp := strconv.Itoa(NoExpiry)
+		if *a.Expires != NoExpiry {
+			exp = expiryDate(*a.Expires)
+		}
+		chageArgs = append(chageArgs, "-E", exp)
+	}
+	if a.MaxDays != nil {
+		chageArgs = append(chageArgs, "-M", strconv.Itoa(*a.MaxDays))
+	}
+	if a.WarnDays != nil {
+		chageArgs = append(chageArgs, "-W", strconv.Itoa(*a.WarnDays))
+	}
+	if a.InactiveDays != nil {
+		chageArgs = append(chageArgs, "-I", strconv.Itoa(*a.InactiveDays))
+	}
+	if len(chageArgs) == 0 {
+		return nil
+	}
+	chageArgs = append(chageArgs, username)
+
+	if err := runCommand("chage", s.rootArgs(chageArgs...)...); err != nil {
+		return fmt.Errorf("Error received while setting account aging for %s: %s", username, err.Error())
+	}
+	return nil
+}
+
+// PasswordChanged returns when the user's password was last changed according
+// to /etc/shadow, which for accounts that have never had a password is when
+// they were created.
+func (s *shadowUtils) PasswordChanged(username string) (time.Time, error) {
+	if s.files != nil {
+		return s.files.PasswordChanged(username)
+	}
+	fields, err := shadowEntry(username)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lastChangeFromShadow(fields), nil
+}
+
+// PasswordLocked checks if the user's password is locked according to
+// /etc/shadow.
+func (s *shadowUtils) PasswordLocked(username string) (bool, error) {
+	if s.files != nil {
+		return s.files.PasswordLocked(username)
+	}
+	fields, err := shadowEntry(username)
+	if err != nil {
+		return false, err
+	}
+	return lockedFromShadow(fields), nil
+}
+
+// rootArgs adds --root to a command's arguments when the accounts are under
+// another root directory.
+func (s *shadowUtils) rootArgs(args ...string) []string {
+	if s.root == "/" {
+		return args
+	}
+	return append([]string{"--root", s.root}, args...)
+}
+
+// runCommand runs one of the account management commands, returning an error
+// with whatever it had to say on stderr if it fails.
+func runCommand(name string, args ...string) error {
+	_, err := command.Run(name, args...)
+	return err
+}
+
+func getShell(username string) (string, error) {
+	var shell string
+	passwd, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "", err
+	}
+	defer passwd.Close()
+	pl := bufio.NewScanner(passwd)
+	for pl.Scan() {
+		line := pl.Text()
+		if strings.HasPrefix(line, fmt.Sprintf("%s:", username)) {
+			fields := strings.Split(line, ":")
+			shell = fields[len(fields)-1]
+			break
+		}
+	}
+	if err = pl.Err(); err != nil {
+		return "", err
+	}
+	return shell, nil
+}
+
+// shadowEntry returns the fields of the user's entry in /etc/shadow.
+func shadowEntry(username string) ([]string, error) {
+	shadow, err := os.Open("/etc/shadow")
+	if err != nil {
+		return nil, err
+	}
+	defer shadow.Close()
+
+	prefix := fmt.Sprintf("%s:", username)
+	sl := bufio.NewScanner(shadow)
+	for sl.Scan() {
+		line := sl.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		// name:password:lastchg:min:max:warn:inactive:expire:reserved
+		fields := strings.Split(line, ":")
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("malformed /etc/shadow entry for %s", username)
+		}
+		return fields, nil
+	}
+	if err = sl.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no /etc/shadow entry found for %s", username)
+}
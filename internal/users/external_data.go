@@ -18,11 +18,14 @@ package users
 
 import (
 	"encoding/json"
+	"github.com/ctdk/spqr/internal/audit"
 	"github.com/ctdk/spqr/internal/groups"
 	"github.com/ctdk/spqr/internal/util"
 	consul "github.com/hashicorp/consul/api"
 	"github.com/tideland/golib/logger"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -31,10 +34,18 @@ type UserExtDataClient struct {
 	userList      []*groups.Member
 	info          []*UserInfo
 	userKeyPrefix string
+	listed        map[string][]byte
+	disablePolicy *groups.DisablePolicy
+	inactiveDays  int
 }
 
-func NewUserExtDataClient(c *consul.Client, userKeyPrefix string) *UserExtDataClient {
-	return &UserExtDataClient{c, []*groups.Member{}, []*UserInfo{}, userKeyPrefix}
+// NewUserExtDataClient makes a new client for fetching user information out of
+// consul. The disable policy is the one from the config file, which group
+// disable policies are layered on top of; it may be nil. Likewise inactiveDays
+// is the config file's limit on how long users may go without logging in,
+// which groups may override.
+func NewUserExtDataClient(c *consul.Client, userKeyPrefix string, disablePolicy *groups.DisablePolicy, inactiveDays int) *UserExtDataClient {
+	return &UserExtDataClient{c, []*groups.Member{}, []*UserInfo{}, userKeyPrefix, nil, disablePolicy, inactiveDays}
 }
 
 // get user information out of consul, get any that are present on the
@@ -56,6 +67,18 @@ func (c *UserExtDataClient) GetUsers(userList []*groups.Member) ([]*User, error)
 			if err != nil {
 				return nil, err
 			}
+			newUser.PrimaryGroup = uEntry.PrimaryGroup
+			if uEntry.Uid != nil {
+				newUser.Uid = strconv.Itoa(*uEntry.Uid)
+			}
+			if uEntry.CreateHome != nil {
+				newUser.createHome = *uEntry.CreateHome
+			}
+			if newUser.aging, err = uEntry.aging(); err != nil {
+				return nil, err
+			}
+			newUser.disableSteps = uEntry.disableSteps
+			newUser.source = uEntry.source
 			usarz = append(usarz, newUser)
 		} else {
 			// user already exists
@@ -63,6 +86,16 @@ func (c *UserExtDataClient) GetUsers(userList []*groups.Member) ([]*User, error)
 			if err != nil {
 				return nil, err
 			}
+			if uEntry.Uid != nil && strconv.Itoa(*uEntry.Uid) != uObj.Uid {
+				logger.Warningf("%s has uid %s, but their user definition says it should be %d. spqr won't change the uid of an existing user.", uObj.Username, uObj.Uid, *uEntry.Uid)
+			}
+			uObj.disableSteps = uEntry.disableSteps
+			uObj.source = uEntry.source
+			uObj.disableReason = uEntry.DisableReason
+			uObj.inactiveDays = uEntry.inactiveDays
+			if uObj.reactivatedAt, err = parseReactivated(uEntry.ReactivatedAt); err != nil {
+				return nil, err
+			}
 			err = uObj.updateInfo(uEntry)
 			if err != nil {
 				return nil, err
@@ -101,33 +134,128 @@ func (c *UserExtDataClient) UpdateUsers(userGaggle []*User) error {
 	return nil
 }
 
+// MatchSelector returns the usernames of every user definition under the user
+// key prefix whose labels match the selector. The whole prefix is listed the
+// first time this is called, and the user definitions are kept around for
+// fetchInfo to use later.
+func (c *UserExtDataClient) MatchSelector(sel groups.Selector) ([]string, error) {
+	if err := c.listUsers(); err != nil {
+		return nil, err
+	}
+
+	var matched []string
+	for name, raw := range c.listed {
+		uInfo := new(UserInfo)
+		if err := json.Unmarshal(raw, &uInfo); err != nil {
+			logger.Warningf("Could not parse user definition for '%s' while matching selector %s: %s", name, sel, err.Error())
+			continue
+		}
+		if sel.Matches(uInfo.Labels) {
+			matched = append(matched, name)
+		}
+	}
+	sort.Strings(matched)
+
+	return matched, nil
+}
+
+// Definitions returns every user definition under the user key prefix, by
+// username. Definitions that can't be parsed are skipped.
+func (c *UserExtDataClient) Definitions() (map[string]*UserInfo, error) {
+	if err := c.listUsers(); err != nil {
+		return nil, err
+	}
+
+	defs := make(map[string]*UserInfo, len(c.listed))
+	for name, raw := range c.listed {
+		uInfo := new(UserInfo)
+		if err := json.Unmarshal(raw, &uInfo); err != nil {
+			logger.Warningf("Could not parse user definition for '%s': %s", name, err.Error())
+			continue
+		}
+		if uInfo.Username == "" {
+			uInfo.Username = name
+		}
+		defs[uInfo.Username] = uInfo
+	}
+
+	return defs, nil
+}
+
+func (c *UserExtDataClient) listUsers() error {
+	if c.listed != nil {
+		return nil
+	}
+
+	prefix := strings.Join([]string{c.userKeyPrefix, ""}, "/")
+	kvals, _, err := c.KV().List(prefix, nil)
+	if err != nil {
+		return err
+	}
+
+	c.listed = make(map[string][]byte, len(kvals))
+	for _, kval := range kvals {
+		name := strings.TrimPrefix(kval.Key, prefix)
+		// skip the prefix itself and anything nested below it
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		c.listed[name] = kval.Value
+	}
+	logger.Debugf("listed %d user definitions under '%s'", len(c.listed), c.userKeyPrefix)
+
+	return nil
+}
+
 func (c *UserExtDataClient) fetchInfo() error {
 	kv := c.KV()
 
 	for _, member := range c.userList {
 		name := member.Username
-		kval, _, err := kv.Get(strings.Join([]string{c.userKeyPrefix, name}, "/"), nil)
-		if err != nil {
-			return err
-		}
 
-		if kval == nil {
-			logger.Errorf("User '%s' not found under '%s'", name, c.userKeyPrefix)
-			continue
+		var raw []byte
+		if r, ok := c.listed[name]; ok {
+			raw = r
+		} else {
+			kval, _, err := kv.Get(strings.Join([]string{c.userKeyPrefix, name}, "/"), nil)
+			if err != nil {
+				return err
+			}
+
+			if kval == nil {
+				logger.Errorf("User '%s' not found under '%s'", name, c.userKeyPrefix)
+				continue
+			}
+			raw = kval.Value
 		}
 
 		uInfo := new(UserInfo)
-		err = json.Unmarshal(kval.Value, &uInfo)
+		err := json.Unmarshal(raw, &uInfo)
 		if err != nil {
 			return err
 		}
 		if uInfo.Username == "" {
 			uInfo.Username = uInfo.Name
 		}
+		applyGroupDefaults(uInfo, member.Defaults)
+		var gdp *groups.DisablePolicy
+		if member.Defaults != nil {
+			gdp = member.Defaults.Disable
+		}
+		uInfo.disableSteps = gdp.Inherit(c.disablePolicy).Resolve()
+		uInfo.source = audit.Source{Key: member.GroupKey, ModifyIndex: member.ModifyIndex}
+		uInfo.inactiveDays = c.inactiveDays
+		if member.Defaults != nil && member.Defaults.InactiveDays != nil {
+			uInfo.inactiveDays = *member.Defaults.InactiveDays
+		}
 		if uInfo.Shell == "" {
 			uInfo.Shell = getDefaultShell()
 		}
-		if member.Status == groups.Disabled {
+		if uInfo.Action == Revoke {
+			uInfo.Action = Disable
+			uInfo.disableSteps.NoticeMinutes = 0
+		}
+		if member.Status == groups.Disabled && uInfo.Action != Delete {
 			uInfo.Action = Disable
 		}
 		if len(member.CommonGroups) >= 0 {
@@ -144,3 +272,24 @@ func (c *UserExtDataClient) fetchInfo() error {
 
 	return nil
 }
+
+// applyGroupDefaults fills in anything the user definition left out with the
+// defaults from the user's groups. Settings in the user definition always win.
+func applyGroupDefaults(uInfo *UserInfo, d *groups.Defaults) {
+	if d == nil {
+		return
+	}
+	if uInfo.Shell == "" {
+		uInfo.Shell = d.Shell
+	}
+	if uInfo.PrimaryGroup == "" {
+		uInfo.PrimaryGroup = d.PrimaryGroup
+	}
+	if uInfo.HomeDir == "" && d.HomeBase != "" {
+		uInfo.HomeDir = path.Join(d.HomeBase, uInfo.Username)
+	}
+	if uInfo.CreateHome == nil && d.CreateHome != nil {
+		ch := *d.CreateHome
+		uInfo.CreateHome = &ch
+	}
+}
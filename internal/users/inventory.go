@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"fmt"
+	"github.com/ctdk/spqr/internal/audit"
+	"github.com/ctdk/spqr/internal/state"
+	"github.com/tideland/golib/logger"
+	"sort"
+	"strings"
+	"time"
+)
+
+// InventoryEntry is what a user's account actually looks like on this
+// machine, as opposed to what their user definition says it should look like.
+type InventoryEntry struct {
+	Username        string   `json:"username"`
+	Uid             string   `json:"uid"`
+	Name            string   `json:"full_name"`
+	HomeDir         string   `json:"home_dir"`
+	Shell           string   `json:"shell"`
+	PrimaryGroup    string   `json:"primary_group"`
+	Groups          []string `json:"groups"`
+	KeyFingerprints []string `json:"key_fingerprints"`
+	Enabled         bool     `json:"enabled"`
+	DisabledSigns   []string `json:"disabled_signs,omitempty"`
+	// LastLogin is when the user last logged in according to wtmp or
+	// lastlog, and LastLoginFrom is where that was recorded. They're left
+	// out if the user has never logged in.
+	LastLogin     *time.Time `json:"last_login,omitempty"`
+	LastLoginFrom string     `json:"last_login_from,omitempty"`
+}
+
+// Inventory looks up each of the named users on this machine. A user counts
+// as disabled if their account shows signs of having been disabled, like a
+// nologin shell or an expired account, or if the user state says they were
+// disabled. Users who don't exist are left out. Nobody logs in to a root
+// directory other than "/", so last logins are only looked up on the real one.
+func Inventory(usernames []string, us *state.UserState) ([]*InventoryEntry, error) {
+	sorted := make([]string, len(usernames))
+	copy(sorted, usernames)
+	sort.Strings(sorted)
+
+	var history *loginHistory
+	if !altRoot() {
+		history = loadLoginHistory()
+	}
+
+	inv := make([]*InventoryEntry, 0, len(sorted))
+	for _, name := range sorted {
+		if !userExists(name) {
+			logger.Debugf("%s doesn't exist, leaving them out of the inventory", name)
+			continue
+		}
+		u, err := Get(name)
+		if err != nil {
+			return nil, err
+		}
+		e := &InventoryEntry{
+			Username:     u.Username,
+			Uid:          u.Uid,
+			Name:         u.Name,
+			HomeDir:      u.HomeDir,
+			Shell:        u.Shell,
+			PrimaryGroup: u.PrimaryGroup,
+			Groups:       u.Groups,
+		}
+		if e.Groups == nil {
+			e.Groups = []string{}
+		}
+		e.KeyFingerprints = make([]string, 0, len(u.AuthorizedKeys))
+		for _, k := range u.AuthorizedKeys {
+			if k = strings.TrimSpace(k); k == "" || strings.HasPrefix(k, "#") {
+				continue
+			}
+			e.KeyFingerprints = append(e.KeyFingerprints, audit.KeyFingerprint(k))
+		}
+		// With nothing to compare against, any nologin shell or expired
+		// account counts.
+		e.DisabledSigns = u.findDisabledSigns(&UserInfo{})
+		if rec := us.Get(name); rec != nil && !rec.DisabledAt.IsZero() {
+			e.DisabledSigns = append(e.DisabledSigns, fmt.Sprintf("recorded as disabled at %s", rec.DisabledAt.Format(time.RFC3339)))
+		}
+		e.Enabled = len(e.DisabledSigns) == 0
+		if history != nil {
+			if last, from := history.lastLogin(u); !last.IsZero() {
+				last = last.UTC()
+				e.LastLogin = &last
+				e.LastLoginFrom = from
+			}
+		}
+		inv = append(inv, e)
+	}
+	return inv, nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"fmt"
+	"github.com/tideland/golib/logger"
+	"strings"
+	"time"
+)
+
+// BlastRadius limits how many users a single run may disable or delete, so a
+// bad bulk edit or a truncated group definition can't lock everyone out at
+// once.
+type BlastRadius struct {
+	// MaxCount is the most users that may be disabled or deleted in one
+	// run. Zero means there's no limit on the count.
+	MaxCount int
+	// MaxPercent is the most users that may be disabled or deleted in one
+	// run, as a percentage of the users being managed. Zero means there's
+	// no limit on the percentage.
+	MaxPercent float64
+	// Override is asked whether the run should go ahead anyway when it
+	// would go over the limit. It may be nil.
+	Override func() bool
+}
+
+// check returns an error if disabling or deleting the given users would go
+// over the limit, unless the limit has been overridden.
+func (b *BlastRadius) check(removing []string, managed int) error {
+	if b == nil || len(removing) == 0 {
+		return nil
+	}
+	n := len(removing)
+	var over []string
+	if b.MaxCount > 0 && n > b.MaxCount {
+		over = append(over, fmt.Sprintf("the limit of %d users", b.MaxCount))
+	}
+	if b.MaxPercent > 0 && managed > 0 {
+		if pct := float64(n) * 100 / float64(managed); pct > b.MaxPercent {
+			over = append(over, fmt.Sprintf("the limit of %g%% of managed users", b.MaxPercent))
+		}
+	}
+	if len(over) == 0 {
+		logger.Debugf("this run will disable or delete %d of %d managed users", n, managed)
+		return nil
+	}
+
+	msg := fmt.Sprintf("this run would disable or delete %d of %d managed users (%s), which is over %s", n, managed, strings.Join(removing, ", "), strings.Join(over, " and "))
+	if b.Override != nil && b.Override() {
+		logger.Warningf("%s, but the limit has been overridden; going ahead", msg)
+		return nil
+	}
+	return fmt.Errorf("Refusing to apply any changes: %s", msg)
+}
+
+// planRemovals works out which users this run will disable or delete, not
+// counting users who were already disabled or are protected.
+func planRemovals(userList []*User, opts *ProcessOptions, now time.Time) []string {
+	var removing []string
+	for _, u := range userList {
+		if u.notExist || opts.Protection.Check(u) != "" {
+			continue
+		}
+		switch u.Action {
+		case Delete:
+			removing = append(removing, u.Username)
+		case Disable:
+			rec := opts.UserState.Get(u.Username)
+			if rec == nil || rec.DisabledAt.IsZero() {
+				if len(u.disabledSigns) == 0 {
+					removing = append(removing, u.Username)
+				}
+				continue
+			}
+			// already disabled, but their time may be up
+			days := u.disableSteps.DeleteAfterDays
+			if days > 0 && !now.Before(rec.DisabledAt.Add(time.Duration(days)*24*time.Hour)) {
+				removing = append(removing, u.Username)
+			}
+		}
+	}
+	return removing
+}
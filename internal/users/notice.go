@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"fmt"
+	"github.com/ctdk/spqr/internal/state"
+	"github.com/tideland/golib/logger"
+	"os"
+	"time"
+)
+
+const noReasonGiven = "no reason was given"
+
+// awaitingNotice checks if the user should be given notice before they're
+// disabled, and if so whether that notice has run out yet. The first time
+// through the disable is scheduled in the user state and the user's sessions
+// are warned. It returns true if the user shouldn't be disabled yet. Nobody
+// can be logged in under a root directory other than "/", so no notice is
+// given there.
+func (u *User) awaitingNotice(us *state.UserState, now time.Time) bool {
+	minutes := u.disableSteps.NoticeMinutes
+	if minutes <= 0 || altRoot() {
+		return false
+	}
+	// Users who are already disabled don't need any more notice.
+	if u.alreadyDisabled(us) {
+		return false
+	}
+	if us == nil {
+		logger.Warningf("%s should be given %d minutes notice before being disabled, but there's no user state file to keep track of it; disabling them now", u.Username, minutes)
+		return false
+	}
+
+	rec := us.Get(u.Username)
+	if rec != nil && !rec.DisableDue.IsZero() {
+		if now.Before(rec.DisableDue) {
+			logger.Debugf("%s is scheduled to be disabled at %s", u.Username, rec.DisableDue.Format(time.RFC3339))
+			return true
+		}
+		logger.Infof("Notice for %s ran out at %s, disabling them", u.Username, rec.DisableDue.Format(time.RFC3339))
+		return false
+	}
+
+	reason := u.disableReason
+	if reason == "" {
+		reason = noReasonGiven
+	}
+	due := us.ScheduleDisable(u.Username, now.Add(time.Duration(minutes)*time.Minute), reason)
+	logger.Infof("Scheduled %s to be disabled at %s: %s", u.Username, due.Format(time.RFC3339), reason)
+
+	if err := u.notifySessions(noticeMessage(u.Username, due, reason)); err != nil {
+		logger.Warningf("could not warn %s that they're being disabled: %s", u.Username, err.Error())
+	}
+	return true
+}
+
+func noticeMessage(username string, due time.Time, reason string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "this machine"
+	}
+	return fmt.Sprintf("\n*** Message from spqr ***\nThe account %s on %s will be disabled at %s.\nReason: %s\nPlease save your work and log out before then.\n\n", username, host, due.Format("2006-01-02 15:04:05 MST"), reason)
+}
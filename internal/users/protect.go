@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LoginDefs is where the range of uids for regular users is read from.
+const LoginDefs = "/etc/login.defs"
+
+// The uid range shadow-utils uses when login.defs doesn't say otherwise.
+const (
+	defaultUidMin = 1000
+	defaultUidMax = 60000
+)
+
+// Protection describes the accounts spqr must never create, modify, disable,
+// or delete, and the processes it must never kill.
+type Protection struct {
+	users     map[string]bool
+	uidMin    int
+	uidMax    int
+	processes []*regexp.Regexp
+}
+
+// NewProtection sets up protection for root, for any account whose uid is
+// outside the UID_MIN to UID_MAX range for regular users in login.defs (system
+// and service accounts, and the likes of nobody), and for the users named in
+// protectedUsers. Processes whose command lines match any of the regular
+// expressions in processPatterns are never killed.
+func NewProtection(protectedUsers []string, processPatterns []string) (*Protection, error) {
+	p := &Protection{users: map[string]bool{"root": true}, uidMin: defaultUidMin, uidMax: defaultUidMax}
+	for _, u := range protectedUsers {
+		p.users[u] = true
+	}
+	for _, pat := range processPatterns {
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protected process pattern '%s': %s", pat, err.Error())
+		}
+		p.processes = append(p.processes, re)
+	}
+	if err := readLoginDefs(rootPath(LoginDefs), map[string]*int{"UID_MIN": &p.uidMin, "UID_MAX": &p.uidMax}); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return p, nil
+}
+
+// readLoginDefs reads the numeric settings given out of login.defs. Settings
+// that aren't in the file are left alone.
+func readLoginDefs(loginDefs string, settings map[string]*int) error {
+	f, err := os.Open(loginDefs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		dst, ok := settings[fields[0]]
+		if !ok {
+			continue
+		}
+		if n, nerr := strconv.Atoi(fields[1]); nerr == nil {
+			*dst = n
+		}
+	}
+	return sc.Err()
+}
+
+// Check returns the reason the user is protected, or an empty string if they
+// aren't. Users that don't exist yet are checked against the uid from their
+// user definition, if it gives one. A nil Protection still protects root.
+func (p *Protection) Check(u *User) string {
+	if u.Username == "root" || u.Uid == "0" {
+		return "root is always protected"
+	}
+	if p == nil {
+		return ""
+	}
+	if p.users[u.Username] {
+		return "they are on the list of protected users"
+	}
+	if u.notExist && u.Uid == "" {
+		return ""
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Sprintf("their uid '%s' could not be parsed", u.Uid)
+	}
+	if uid < p.uidMin || uid > p.uidMax {
+		return fmt.Sprintf("their uid %d is outside the range for regular users (%d-%d)", uid, p.uidMin, p.uidMax)
+	}
+	return ""
+}
+
+// ProcessPatterns returns the patterns of processes that must never be
+// killed.
+func (p *Protection) ProcessPatterns() []*regexp.Regexp {
+	if p == nil {
+		return nil
+	}
+	return p.processes
+}
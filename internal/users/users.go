@@ -20,9 +20,14 @@ package users
 
 import (
 	"fmt"
+	"github.com/ctdk/spqr/internal/audit"
+	"github.com/ctdk/spqr/internal/groups"
+	"github.com/ctdk/spqr/internal/state"
 	"github.com/tideland/golib/logger"
 	"os/user"
 	"sort"
+	"strings"
+	"time"
 )
 
 type UserAction string
@@ -31,8 +36,79 @@ const (
 	NullAction UserAction = "null"
 	Create                = "create"
 	Disable               = "disable"
+	Delete                = "delete"
+	Revoke                = "revoke"
 )
 
+// DefaultArchiveDir is where home directories are archived to before their
+// users are deleted, unless configured otherwise.
+const DefaultArchiveDir = "/var/lib/spqr/archive"
+
+// ProcessOptions holds the settings ProcessUsers needs besides the users
+// themselves.
+type ProcessOptions struct {
+	// UserState records when users were disabled. It may be nil, in which
+	// case users are never deleted automatically.
+	UserState *state.UserState
+	// ArchiveDir is where home directories are archived before their
+	// users are deleted.
+	ArchiveDir string
+	// Protection keeps spqr's hands off of system accounts and protected
+	// processes. If it's nil only root is protected.
+	Protection *Protection
+	// BlastRadius limits how many users may be disabled or deleted in one
+	// run. If it's nil there's no limit.
+	BlastRadius *BlastRadius
+	// Managed is how many users spqr manages on this machine altogether,
+	// counting the members of groups that haven't changed since they were
+	// last applied as well as the users being processed. The blast
+	// radius's percentage limit is worked out from it. If it's less than
+	// the number of users being processed, they're counted instead.
+	Managed int
+	// Audit is where the changes made to users are recorded. It may be
+	// nil.
+	Audit *audit.Log
+	// Results, if it isn't nil, is filled in with how processing each
+	// user went.
+	Results Results
+}
+
+// How processing a user went.
+const (
+	ResultOK        = "ok"
+	ResultFailed    = "failed"
+	ResultPending   = "pending"
+	ResultProtected = "protected"
+	ResultAbsent    = "absent"
+	ResultSkipped   = "skipped"
+)
+
+// UserResult is how processing a user went. The result is one of the Result
+// constants: "ok" if the user is as they should be, "failed" if there was an
+// error, "pending" if they're being given notice before being disabled,
+// "protected" if spqr wouldn't touch them, "absent" if a user who was to be
+// disabled or deleted didn't exist, and "skipped" if the run stopped before
+// getting to them.
+type UserResult struct {
+	Action UserAction `json:"action"`
+	Result string     `json:"result"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// Results holds how processing each user went, by username.
+type Results map[string]*UserResult
+
+func (r Results) set(u *User, result string, err error) {
+	if r == nil {
+		return
+	}
+	ur := &UserResult{Action: u.Action, Result: result}
+	if err != nil {
+		ur.Error = err.Error()
+	}
+	r[u.Username] = ur
+}
+
 type User struct {
 	*user.User
 	AuthorizedKeys []string
@@ -43,18 +119,38 @@ type User struct {
 	changed        bool
 	notExist       bool
 	updated        *userUpdated
+	createHome     bool
+	aging          *Aging
+	disableSteps   groups.DisableSteps
+	disabledSigns  []string
+	protection     *Protection
+	disableReason  string
+	inactiveDays   int
+	reactivatedAt  time.Time
+	source         audit.Source
+	audit          *audit.Log
 }
 
 type UserInfo struct {
-	Username       string     `json:"username"`
-	Name           string     `json:"full_name"`
-	Groups         []string   `json:"groups"`
-	PrimaryGroup   string     `json:"primary_group"`
-	HomeDir        string     `json:"home_dir"`
-	Shell          string     `json:"shell"`
-	Action         UserAction `json:"action"`
-	DoesNotExist   bool       `json:"does_not_exist"`
-	AuthorizedKeys []string   `json:"authorized_keys"`
+	Username       string            `json:"username"`
+	Uid            *int              `json:"uid"`
+	Name           string            `json:"full_name"`
+	Groups         []string          `json:"groups"`
+	PrimaryGroup   string            `json:"primary_group"`
+	HomeDir        string            `json:"home_dir"`
+	Shell          string            `json:"shell"`
+	Action         UserAction        `json:"action"`
+	DoesNotExist   bool              `json:"does_not_exist"`
+	AuthorizedKeys []string          `json:"authorized_keys"`
+	Labels         map[string]string `json:"labels"`
+	CreateHome     *bool             `json:"create_home"`
+	ExpiresAt      string            `json:"expires_at"`
+	PasswordAging  *PasswordAging    `json:"password_aging"`
+	DisableReason  string            `json:"disable_reason"`
+	ReactivatedAt  string            `json:"reactivated_at"`
+	disableSteps   groups.DisableSteps
+	inactiveDays   int
+	source         audit.Source
 }
 
 type userUpdated struct {
@@ -63,6 +159,7 @@ type userUpdated struct {
 	primaryGroup   string
 	shell          string
 	authorizedKeys []string
+	aging          *Aging
 }
 
 // New creates a new user. It's a pass-through to an OS-specific function, see
@@ -73,33 +170,27 @@ func New(userName string, fullName string, homeDir string, shell string, action
 
 // Get a user, if it exists.
 func Get(username string) (*User, error) {
-	osUser, err := user.Lookup(username)
+	a, err := currentBackend().LookupUser(username)
 	if err != nil {
 		return nil, err
 	}
+	osUser := &user.User{Uid: a.Uid, Gid: a.Gid, Username: a.Username, Name: a.Name, HomeDir: a.HomeDir}
 
-	u := &User{osUser, nil, "", NullAction, nil, "", false, false, nil}
+	u := &User{User: osUser, Shell: a.Shell, Action: NullAction, disableSteps: defaultDisableSteps()}
 
 	err = u.fillInUser()
 	if err != nil {
 		return nil, err
 	}
 
-	pg, err := u.getPrimaryGroup()
-	logger.Debugf("primary group for %s: '%s'", u.Username, pg)
-	if err != nil {
-		return nil, err
-	}
-	u.PrimaryGroup = pg
-
-	gids, _ := u.GroupIds()
+	u.PrimaryGroup = a.PrimaryGroup
+	logger.Debugf("primary group for %s: '%s'", u.Username, u.PrimaryGroup)
 
-	for _, g := range gids {
-		gr, _ := user.LookupGroupId(g)
-		if gr.Name == u.PrimaryGroup {
+	for _, g := range a.Groups {
+		if g == u.PrimaryGroup {
 			continue
 		}
-		u.Groups = append(u.Groups, gr.Name)
+		u.Groups = append(u.Groups, g)
 	}
 	sort.Strings(u.Groups)
 
@@ -114,27 +205,103 @@ func (u *User) Update() error {
 	return u.update()
 }
 
+// Disable disables the user's account. What exactly is done depends on the
+// user's disable policy; by default the account is locked, the shell set to
+// nologin, their ssh keys removed, their secondary groups cleared, and their
+// processes killed.
 func (u *User) Disable() error {
-	err := u.setNoLogin()
-	if err != nil {
+	ds := u.disableSteps
+
+	if ds.LockPassword {
+		if err := u.passwdManipulate(true); err != nil {
+			return err
+		}
+	}
+
+	if ds.NoLoginShell && u.Shell != NoLoginShell {
+		if err := u.changeShell(NoLoginShell); err != nil {
+			return err
+		}
+	}
+
+	if ds.ExpireAccount {
+		if err := u.expireAccount(); err != nil {
+			return err
+		}
+	}
+
+	if ds.DeleteKeys {
+		if err := u.deleteAuthKeys(); err != nil {
+			return err
+		}
+	}
+
+	if ds.ClearGroups {
+		if err := u.clearExtraGroups(ds.KeepGroups); err != nil {
+			return err
+		}
+	}
+
+	if ds.KillProcesses {
+		if err := u.killProcesses(); err != nil {
+			return err
+		}
+	} else {
+		logger.Debugf("Leaving processes for disabled user %s running, per the disable policy", u.Username)
+	}
+
+	if ds.MoveHome {
+		if err := u.moveHomeAside(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// alreadyDisabled returns true if the user has been disabled already, either
+// according to the user state or because of the signs of it found on the
+// system.
+func (u *User) alreadyDisabled(us *state.UserState) bool {
+	if rec := us.Get(u.Username); rec != nil && !rec.DisabledAt.IsZero() {
+		return true
+	}
+	return len(u.disabledSigns) > 0
+}
+
+func defaultDisableSteps() groups.DisableSteps {
+	var dp *groups.DisablePolicy
+	return dp.Resolve()
+}
+
+// Reenable brings a previously disabled user back. Anything disabling the user
+// may have done is undone: the account is unlocked, any expiry date is
+// cleared, and a home directory that was moved aside is moved back. Then the
+// user's shell, keys, and groups are restored from their user definition like
+// any other update. This happens the same way no matter how the user came to
+// be disabled.
+func (u *User) Reenable() error {
+	logger.Infof("Re-enabling user %s: %s", u.Username, strings.Join(u.disabledSigns, "; "))
+
+	if err := u.passwdManipulate(false); err != nil {
 		return err
 	}
 
-	err = u.deleteAuthKeys()
-	if err != nil {
+	if err := u.clearExpiry(); err != nil {
 		return err
 	}
 
-	err = u.clearExtraGroups()
-	if err != nil {
+	if err := u.restoreHome(); err != nil {
 		return err
 	}
 
-	err = u.killProcesses()
-	if err != nil {
+	if err := u.Update(); err != nil {
 		return err
 	}
 
+	u.record(&audit.Entry{Change: audit.Reenable, Reason: strings.Join(u.disabledSigns, "; ")})
+	u.disabledSigns = nil
+	logger.Infof("Re-enabled user %s", u.Username)
 	return nil
 }
 
@@ -144,47 +311,193 @@ func MakeNewGroup(groupName string) error {
 }
 
 // ProcessUsers updates or create users as needed.
-func ProcessUsers(userList []*User) error {
+func ProcessUsers(userList []*User, opts *ProcessOptions) error {
+	if opts == nil {
+		prot, err := NewProtection(nil, nil)
+		if err != nil {
+			return err
+		}
+		opts = &ProcessOptions{ArchiveDir: DefaultArchiveDir, Protection: prot}
+	}
 	existingGroups := make(map[string]bool)
+	now := time.Now()
+
+	checkActivity(userList, now)
+
+	managed := opts.Managed
+	if managed < len(userList) {
+		managed = len(userList)
+	}
+	if err := opts.BlastRadius.check(planRemovals(userList, opts, now), managed); err != nil {
+		return err
+	}
+
+	for i, u := range userList {
+		if reason := opts.Protection.Check(u); reason != "" {
+			logger.Warningf("Not touching protected user %s (action %s): %s", u.Username, u.Action, reason)
+			opts.Results.set(u, ResultProtected, nil)
+			continue
+		}
+		u.protection = opts.Protection
+		u.audit = opts.Audit
+
+		result, err := u.process(opts, existingGroups, now)
+		opts.Results.set(u, result, err)
+		if err != nil {
+			for _, skipped := range userList[i+1:] {
+				opts.Results.set(skipped, ResultSkipped, nil)
+			}
+			return err
+		}
+	}
+	return nil
+}
 
-	for _, u := range userList {
-		// Check for OS groups and create them if needed
-		for _, g := range u.Groups {
-			if !existingGroups[g] {
-				if err := checkOrCreateGroup(g); err != nil {
-					return err
-				}
-				existingGroups[g] = true
+// process does whatever needs doing to a single user, returning how it went.
+func (u *User) process(opts *ProcessOptions, existingGroups map[string]bool, now time.Time) (string, error) {
+	// Check for OS groups and create them if needed
+	osGroups := u.Groups
+	if u.PrimaryGroup != "" && u.Action != Disable {
+		osGroups = append([]string{u.PrimaryGroup}, osGroups...)
+	}
+	if u.Action == Delete {
+		osGroups = nil
+	}
+	for _, g := range osGroups {
+		if !existingGroups[g] {
+			if err := checkOrCreateGroup(g); err != nil {
+				return ResultFailed, err
 			}
+			existingGroups[g] = true
 		}
+	}
 
-		if u.notExist && u.Action != Disable {
-			err := u.osCreateUser()
-			if err != nil {
-				uerr := fmt.Errorf("Error attempting to create user %s: %s", u.Username, err.Error())
-				return uerr
+	switch {
+	case u.Action == Delete:
+		if u.notExist {
+			opts.UserState.Remove(u.Username)
+			return ResultAbsent, nil
+		}
+		if err := u.Delete(opts.ArchiveDir); err != nil {
+			return ResultFailed, err
+		}
+		opts.UserState.Remove(u.Username)
+	case u.Action == Disable:
+		if u.notExist {
+			return ResultAbsent, nil
+		}
+		// The disable policy is applied on every run, so anything that
+		// didn't work last time or has been put back since is taken care
+		// of, but users who were already disabled aren't recorded as
+		// being disabled all over again.
+		already := u.alreadyDisabled(opts.UserState)
+		if u.awaitingNotice(opts.UserState, now) {
+			return ResultPending, nil
+		}
+		if err := u.Disable(); err != nil {
+			return ResultFailed, err
+		}
+		if !already {
+			u.record(&audit.Entry{Change: audit.Disable, Reason: u.disableReason})
+			if u.disableSteps.ExpireAccount {
+				opts.UserState.MarkExpired(u.Username, now)
+			}
+		}
+		disabledAt := opts.UserState.MarkDisabled(u.Username, now, u.disableReason)
+		if err := u.checkRetention(disabledAt, now, opts); err != nil {
+			return ResultFailed, err
+		}
+	case u.notExist:
+		err := u.osCreateUser()
+		if err != nil {
+			uerr := fmt.Errorf("Error attempting to create user %s: %s", u.Username, err.Error())
+			return ResultFailed, uerr
+		}
+		opts.UserState.ClearDisabled(u.Username)
+	default:
+		if rec := opts.UserState.Get(u.Username); rec != nil {
+			if !rec.DisabledAt.IsZero() {
+				u.disabledSigns = append(u.disabledSigns, fmt.Sprintf("recorded as disabled at %s", rec.DisabledAt.Format(time.RFC3339)))
 			}
-		} else if u.Action == Disable {
-			if !u.notExist {
-				err := u.Disable()
-				if err != nil {
-					return err
-				}
+			if !rec.ExpiredAt.IsZero() {
+				u.disabledSigns = append(u.disabledSigns, fmt.Sprintf("account expired by spqr at %s", rec.ExpiredAt.Format(time.RFC3339)))
 			}
+		}
+		var err error
+		if len(u.disabledSigns) > 0 {
+			err = u.Reenable()
 		} else {
-			err := u.Update()
-			if err != nil {
-				return err
-			}
+			err = u.Update()
 		}
+		if err != nil {
+			return ResultFailed, err
+		}
+		opts.UserState.ClearDisabled(u.Username)
+	}
+	return ResultOK, nil
+}
+
+// checkRetention deletes a disabled user once they've been disabled for longer
+// than their disable policy allows.
+func (u *User) checkRetention(disabledAt time.Time, now time.Time, opts *ProcessOptions) error {
+	days := u.disableSteps.DeleteAfterDays
+	if days <= 0 {
+		return nil
+	}
+	if disabledAt.IsZero() {
+		logger.Warningf("%s should be deleted %d days after being disabled, but there's no user state file to record when that happened", u.Username, days)
+		return nil
 	}
+	deleteAt := disabledAt.Add(time.Duration(days) * 24 * time.Hour)
+	if now.Before(deleteAt) {
+		logger.Debugf("%s was disabled at %s, and will be deleted after %s", u.Username, disabledAt.Format(time.RFC3339), deleteAt.Format(time.RFC3339))
+		return nil
+	}
+	logger.Infof("%s was disabled at %s, more than %d days ago; deleting them", u.Username, disabledAt.Format(time.RFC3339), days)
+	if err := u.Delete(opts.ArchiveDir); err != nil {
+		return err
+	}
+	opts.UserState.Remove(u.Username)
+	return nil
+}
+
+// Delete archives the user's home directory and then removes the user from
+// the system entirely. If the home directory can't be archived the user is
+// left alone.
+func (u *User) Delete(archiveDir string) error {
+	if u.Uid == "0" {
+		return fmt.Errorf("Will not delete %s, who has uid 0", u.Username)
+	}
+	if archiveDir == "" {
+		archiveDir = DefaultArchiveDir
+	}
+
+	// Nothing should be running as the user when they're archived and
+	// deleted.
+	if err := u.killProcesses(); err != nil {
+		return err
+	}
+
+	archivePath, err := u.archiveHome(archiveDir)
+	if err != nil {
+		return fmt.Errorf("Error archiving the home directory of %s, not deleting them: %s", u.Username, err.Error())
+	}
+
+	if err = u.osDeleteUser(archivePath != ""); err != nil {
+		return err
+	}
+	u.record(&audit.Entry{Change: audit.Delete, Archive: archivePath})
+	logger.Infof("Deleted user %s", u.Username)
 	return nil
 }
 
 func checkOrCreateGroup(name string) error {
 	logger.Debugf("looking up group %s", name)
-	gPresent, _ := user.LookupGroup(name)
-	if gPresent == nil {
+	gPresent, err := currentBackend().GroupExists(name)
+	if err != nil {
+		return err
+	}
+	if !gPresent {
 		err := MakeNewGroup(name)
 		if err != nil {
 			return err
@@ -192,3 +505,11 @@ func checkOrCreateGroup(name string) error {
 	}
 	return nil
 }
+
+// record adds an entry about a change made to the user to the audit log, if
+// there is one.
+func (u *User) record(e *audit.Entry) {
+	e.User = u.Username
+	e.Source = u.source
+	u.audit.Record(e)
+}
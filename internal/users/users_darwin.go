@@ -20,38 +20,25 @@ package users
 
 import (
 	"errors"
+	"time"
 )
 
 // no-op (+ error) at the moment
 
-func (u *User) osCreateUser() error {
-	return errors.New("user creation not supported on darwin")
-}
-
-func getShell(username string) (string, error) {
-	return "", errors.New("getting a user's shell is not supported on darwin")
-}
-
-func osMakeNewGroup(groupName string) error {
-	return errors.New("creating new groups is not supported on darwin")
-}
-
 func (u *User) killProcesses() error {
 	return errors.New("killProcesses not implemented on darwin")
 }
 
-func (u *User) clearExtraGroups() error {
-	return errors.New("clearExtraGroups not implemented on darwin")
+func (u *User) notifySessions(msg string) error {
+	return errors.New("notifySessions not implemented on darwin")
 }
 
-func (u *User) updateGroups() error {
-	return errors.New("updateGroups not implemented on darwin")
-}
+type loginHistory struct{}
 
-func (u *User) updateName() error {
-	return errors.New("updateName not implemented on darwin")
+func loadLoginHistory() *loginHistory {
+	return &loginHistory{}
 }
 
-func (u *User) passwdManipulate(lock bool) error {
-	return errors.New("passwdManipulate not implemented on darwin")
+func (h *loginHistory) lastLogin(u *User) (time.Time, string) {
+	return time.Time{}, ""
 }
@@ -16,218 +16,51 @@
  * limitations under the License.
  */
 
-// linux specific functionality to create users
-// NB: Most/everything in this file is probably applicable to most if not all
-// non-darwin Unixes, so the file may need moved to a new name (with any truly
-// linux-specific items moved back into users_linux.go accordingly).
+// linux specific functionality for managing users. Creating and changing the
+// accounts themselves is up to the account backends.
 
 package users
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
+	"github.com/ctdk/spqr/internal/audit"
 	"github.com/ctdk/spqr/internal/processes"
 	"github.com/tideland/golib/logger"
-	"os"
-	"os/exec"
-	"strings"
+	"time"
 )
 
-func (u *User) osCreateUser() error {
-	useraddPath, err := exec.LookPath("useradd")
-	if err != nil {
-		return err
-	}
-
-	useraddArgs := []string{"-m", "-U", "-s", u.Shell}
-
-	if u.Name != "" {
-		useraddArgs = append(useraddArgs, []string{"-c", u.Name}...)
-	}
-
-	if len(u.Groups) > 0 {
-		useraddArgs = append(useraddArgs, []string{"-G", strings.Join(u.Groups, ",")}...)
-	}
-
-	if u.PrimaryGroup != "" {
-		useraddArgs = append(useraddArgs, []string{"-g", u.PrimaryGroup}...)
-	}
-
-	if u.HomeDir != "" {
-		useraddArgs = append(useraddArgs, "-d", u.HomeDir)
-	}
-
-	useraddArgs = append(useraddArgs, u.Username)
-
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-
-	useradd := exec.Command(useraddPath, useraddArgs...)
-	useradd.Stdout = &stdout
-	useradd.Stderr = &stderr
-
-	err = useradd.Run()
-	if err != nil {
-		ferr := fmt.Errorf("Error received while trying to create user: %s -- error from useradd program: %s", err.Error(), stderr.String())
-		return ferr
-	}
-
-	nu, err := Get(u.Username)
-
-	if err != nil {
-		return err
-	}
-
-	authKeys := u.AuthorizedKeys
-	u = nu
-
-	// save the keys
-	err = u.writeOutKeys(authKeys)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func osMakeNewGroup(groupName string) error {
-	groupaddPath, err := exec.LookPath("groupadd")
-	if err != nil {
-		return err
-	}
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-
-	groupadd := exec.Command(groupaddPath, groupName)
-	groupadd.Stdout = &stdout
-	groupadd.Stderr = &stderr
-	err = groupadd.Run()
-	if err != nil {
-		return fmt.Errorf("Error received trying to create group %s: %s %s", groupName, err.Error(), stderr.String())
-	}
-	return nil
-}
-
-func getShell(username string) (string, error) {
-	var shell string
-	passwd, err := os.Open("/etc/passwd")
-	if err != nil {
-		return "", err
-	}
-	defer passwd.Close()
-	pl := bufio.NewScanner(passwd)
-	for pl.Scan() {
-		line := pl.Text()
-		if strings.HasPrefix(line, fmt.Sprintf("%s:", username)) {
-			fields := strings.Split(line, ":")
-			shell = fields[len(fields)-1]
-			break
-		}
-	}
-	if err = pl.Err(); err != nil {
-		return "", err
-	}
-	return shell, nil
-}
-
 func (u *User) killProcesses() error {
 	if u.Uid == "0" {
 		return fmt.Errorf("Will not kill processes for uid 0")
 	}
-
-	// kill the processes
-	return processes.KillUserProcesses(u.Uid)
-}
-
-func (u *User) clearExtraGroups() error {
-	// inside docker at least 'groupmems' required a password to add/remove
-	// users from a group. Weeeeeird.
-	// Bail early if the user is already not in any extra groups
-	if len(u.Groups) == 0 {
+	// processes running on this machine have nothing to do with the
+	// accounts under another root directory, even with the same uid.
+	if altRoot() {
+		logger.Debugf("Not killing processes for %s, who lives under %s", u.Username, rootDir)
 		return nil
 	}
-	uUp := new(userUpdated)
-	uUp.groups = make([]string, 0)
-	u.updated = uUp
-	logger.Debugf("Removing %s from all extra groups", u.Username)
-	return u.updateGroups()
-}
-
-func (u *User) updateName() error {
-	userModArgs := []string{"-c", u.updated.name}
-	logger.Debugf("Updating full name for %s to '%s'", u.Username, u.updated.name)
-	return u.runUserMod(userModArgs)
-}
-
-func (u *User) updateGroups() error {
-	userModArgs := make([]string, 0, 4)
-
-	if u.updated.groups != nil {
-		for _, g := range u.updated.groups {
-			if err := checkOrCreateGroup(g); err != nil {
-				return err
-			}
-		}
-		ua := []string{"-G", strings.Join(u.updated.groups, ",")}
-		logger.Debugf("Updating groups for %s to '%s'", u.Username, strings.Join(u.updated.groups, ","))
-		userModArgs = append(userModArgs, ua...)
-	}
 
-	if u.updated.primaryGroup != "" {
-		ua := []string{"-g", u.updated.primaryGroup}
-		logger.Debugf("Updating primary group for %s to '%s'", u.Username, u.updated.primaryGroup)
-		userModArgs = append(userModArgs, ua...)
+	// end the processes, gently at first
+	opts := &processes.KillOptions{
+		TerminateSessions: u.disableSteps.TerminateSessions,
+		GracePeriod:       time.Duration(u.disableSteps.KillGraceSeconds) * time.Second,
+		Protected:         u.protection.ProcessPatterns(),
 	}
-
-	logger.Debugf("running usermod on '%s' with these arguments: %s", u.Username, strings.Join(userModArgs, " "))
-	return u.runUserMod(userModArgs)
-}
-
-func (u *User) runUserMod(userModArgs []string) error {
-	usermodPath, err := exec.LookPath("usermod")
+	reports, err := processes.KillUserProcesses(u.Uid, opts)
 	if err != nil {
 		return err
 	}
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	userModArgs = append(userModArgs, u.Username)
-	usermod := exec.Command(usermodPath, userModArgs...)
-	usermod.Stdout = &stdout
-	usermod.Stderr = &stderr
-
-	err = usermod.Run()
-	if err != nil {
-		return fmt.Errorf("Error received while modifying %s: %s :: %s", u.Username, err.Error(), stderr.String())
-	}
-	return nil
-}
-
-func (u *User) passwdManipulate(lock bool) error {
-	pPath, err := exec.LookPath("passwd") // can't imagine that would fail
-	if err != nil {
-		return err
-	}
-
-	var op string
-	if lock {
-		op = "-l"
-	} else {
-		op = "-u"
-	}
-
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	p := exec.Command(pPath, op, u.Username)
-	p.Stdout = &stdout
-	p.Stderr = &stderr
-
-	err = p.Run()
-	if err != nil {
-		if !lock && !strings.Contains(stderr.String(), "passwordless account") {
-			return fmt.Errorf("Error received while locking/unlocking account %s: %s :: %s || l %v c %v a %v", u.Username, err.Error(), stderr.String(), !lock, strings.Contains(stderr.String(), "passwordless account"), !(!lock && !strings.Contains(stderr.String(), "passwordless account")))
+	var killed []int
+	for _, r := range reports {
+		switch r.Outcome {
+		case processes.OutcomeSurvived:
+			logger.Warningf("Process %d (%s) belonging to %s survived being killed", r.Pid, r.Cmdline, u.Username)
+		case processes.OutcomeSessionTerminated, processes.OutcomeTerminated, processes.OutcomeCgroupKilled, processes.OutcomeKilled:
+			killed = append(killed, r.Pid)
 		}
 	}
-
+	if len(killed) > 0 {
+		u.record(&audit.Entry{Change: audit.ProcessesKilled, Pids: killed})
+	}
 	return nil
 }
@@ -0,0 +1,285 @@
+// +build linux darwin
+
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/ctdk/spqr/internal/audit"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAII3W7t/SLtzcKVxjclFTwT0w3jlTyAuNV01xouUMaM88 baz"
+
+// testEnv sets up the memory backend, managing users under a temporary root
+// directory with an audit log in it.
+type testEnv struct {
+	t       *testing.T
+	root    string
+	backend *memoryBackend
+	audit   *audit.Log
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	root, err := ioutil.TempDir("", "spqr-users-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRoot(root)
+	b := newMemoryBackend()
+	SetBackend(b)
+	// The ssh keys are written out for real, so the users' primary group
+	// and uid need to be ones the test can chown files to.
+	b.groups["testers"] = &memoryGroup{gid: strconv.Itoa(os.Getgid()), members: make(map[string]bool)}
+	al, err := audit.Open(path.Join(root, "audit.log"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{t: t, root: root, backend: b, audit: al}
+}
+
+func (e *testEnv) close() {
+	e.audit.Close()
+	SetBackend(nil)
+	SetRoot("/")
+	os.RemoveAll(e.root)
+}
+
+func testUid() string {
+	// root can chown to anyone, but uid 0 is protected
+	if os.Getuid() == 0 {
+		return "1001"
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+func (e *testEnv) process(userList ...*User) {
+	if err := ProcessUsers(userList, &ProcessOptions{Audit: e.audit}); err != nil {
+		e.t.Fatalf("processing users: %s", err.Error())
+	}
+}
+
+// create makes baz, in the wheel group and with an ssh key.
+func (e *testEnv) create() {
+	u, err := New("baz", "Baz Quux", "", DefaultShell, Create, []string{"wheel"}, []string{testKey})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	u.Uid = testUid()
+	u.PrimaryGroup = "testers"
+	e.process(u)
+}
+
+// definition looks baz up and compares them to their user definition, the
+// way GetUsers does.
+func (e *testEnv) definition(ui *UserInfo) *User {
+	u, err := Get(ui.Username)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if err = u.updateInfo(ui); err != nil {
+		e.t.Fatal(err)
+	}
+	return u
+}
+
+func (e *testEnv) enabledDefinition() *UserInfo {
+	return &UserInfo{Username: "baz", Shell: DefaultShell, Action: Create, Groups: []string{"wheel"}, PrimaryGroup: "testers", AuthorizedKeys: []string{testKey}}
+}
+
+func (e *testEnv) disable() {
+	e.process(e.definition(&UserInfo{Username: "baz", Action: Disable}))
+}
+
+// changes returns the kinds of changes in the audit log, in order.
+func (e *testEnv) changes() []string {
+	f, err := os.Open(path.Join(e.root, "audit.log"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer f.Close()
+	var changes []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var entry audit.Entry
+		if err = json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			e.t.Fatal(err)
+		}
+		changes = append(changes, string(entry.Change))
+	}
+	return changes
+}
+
+func (e *testEnv) keys() []string {
+	keys, err := getAuthorizedKeys(path.Join(e.root, DefaultHomeBase, "baz", ".ssh", "authorized_keys"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return keys
+}
+
+func TestCreateUser(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.create()
+
+	a, err := e.backend.LookupUser("baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Uid != testUid() || a.Shell != DefaultShell || a.PrimaryGroup != "testers" || !reflect.DeepEqual(a.Groups, []string{"wheel"}) {
+		t.Errorf("baz wasn't created as they should have been: %+v", a)
+	}
+	if keys := e.keys(); !reflect.DeepEqual(keys, []string{testKey}) {
+		t.Errorf("got keys %v, wanted %v", keys, []string{testKey})
+	}
+	if changes := e.changes(); !reflect.DeepEqual(changes, []string{"create", "key_added"}) {
+		t.Errorf("got audit log changes %v", changes)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.create()
+	e.disable()
+
+	a, _ := e.backend.LookupUser("baz")
+	if a.Shell != NoLoginShell {
+		t.Errorf("baz's shell is %s, not %s", a.Shell, NoLoginShell)
+	}
+	if len(a.Groups) != 0 {
+		t.Errorf("baz is still in groups %v", a.Groups)
+	}
+	if !e.backend.users["baz"].locked {
+		t.Errorf("baz's password wasn't locked")
+	}
+	if keys := e.keys(); len(keys) != 0 {
+		t.Errorf("baz still has keys %v", keys)
+	}
+	want := []string{"create", "key_added", "shell", "key_removed", "groups", "disable"}
+	if changes := e.changes(); !reflect.DeepEqual(changes, want) {
+		t.Errorf("got audit log changes %v, wanted %v", changes, want)
+	}
+
+	// Disabling them again shouldn't record anything new.
+	e.disable()
+	if changes := e.changes(); !reflect.DeepEqual(changes, want) {
+		t.Errorf("disabling baz again changed the audit log to %v", changes)
+	}
+}
+
+func TestDisableFinishesPartialDisable(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.create()
+	// As if a disable got as far as the shell and then failed.
+	if err := e.backend.ModifyUser("baz", &AccountChanges{Shell: NoLoginShell}); err != nil {
+		t.Fatal(err)
+	}
+	e.disable()
+
+	if keys := e.keys(); len(keys) != 0 {
+		t.Errorf("baz still has keys %v", keys)
+	}
+	if a, _ := e.backend.LookupUser("baz"); len(a.Groups) != 0 {
+		t.Errorf("baz is still in groups %v", a.Groups)
+	}
+	want := []string{"create", "key_added", "key_removed", "groups"}
+	if changes := e.changes(); !reflect.DeepEqual(changes, want) {
+		t.Errorf("got audit log changes %v, wanted %v", changes, want)
+	}
+}
+
+func TestReenableUser(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.create()
+	e.disable()
+
+	u := e.definition(e.enabledDefinition())
+	if len(u.disabledSigns) == 0 {
+		t.Fatalf("no signs that baz was disabled were found")
+	}
+	e.process(u)
+
+	a, _ := e.backend.LookupUser("baz")
+	if a.Shell != DefaultShell || !reflect.DeepEqual(a.Groups, []string{"wheel"}) {
+		t.Errorf("baz wasn't restored: %+v", a)
+	}
+	if e.backend.users["baz"].locked {
+		t.Errorf("baz's password is still locked")
+	}
+	if keys := e.keys(); !reflect.DeepEqual(keys, []string{testKey}) {
+		t.Errorf("got keys %v, wanted %v", keys, []string{testKey})
+	}
+	if changes := e.changes(); changes[len(changes)-1] != "reenable" {
+		t.Errorf("re-enabling wasn't the last change in the audit log: %v", changes)
+	}
+}
+
+func TestReenableLockOnly(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.create()
+	// A user with a password, disabled by a policy that only locks it.
+	e.backend.users["baz"].password = "$6$salt$hash"
+	e.backend.users["baz"].locked = true
+
+	u := e.definition(e.enabledDefinition())
+	if !reflect.DeepEqual(u.disabledSigns, []string{"password is locked"}) {
+		t.Fatalf("got disabled signs %v", u.disabledSigns)
+	}
+	e.process(u)
+	if e.backend.users["baz"].locked {
+		t.Errorf("baz's password is still locked")
+	}
+}
+
+func TestReenableExpiredOnly(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.create()
+	expired := 1
+	if err := e.backend.SetAging("baz", &Aging{Expires: &expired}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expiry date the definition asks for isn't a sign of anything.
+	ui := e.enabledDefinition()
+	ui.ExpiresAt = "1970-01-02"
+	if u := e.definition(ui); len(u.disabledSigns) != 0 {
+		t.Errorf("got disabled signs %v for an expiry date from the definition", u.disabledSigns)
+	}
+
+	u := e.definition(e.enabledDefinition())
+	if len(u.disabledSigns) != 1 || !strings.HasPrefix(u.disabledSigns[0], "account expired") {
+		t.Fatalf("got disabled signs %v", u.disabledSigns)
+	}
+	e.process(u)
+	if a, _ := e.backend.GetAging("baz"); *a.Expires != NoExpiry {
+		t.Errorf("baz's account still expires on day %d", *a.Expires)
+	}
+}
@@ -22,19 +22,19 @@ package users
 
 import (
 	"bufio"
-	"bytes"
 	"crypto/rand"
 	"fmt"
+	"github.com/ctdk/spqr/internal/audit"
 	"github.com/ctdk/spqr/internal/util"
 	"github.com/tideland/golib/logger"
 	"math/big"
 	"os"
-	"os/exec"
 	"os/user"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const sshDirPerm = 0700
@@ -46,18 +46,19 @@ var maxTmpDirNum *big.Int
 const DefaultShell = "/bin/bash"
 const DefaultHomeBase = "/home"
 
+// NoLoginShell is the shell disabled users are given.
+const NoLoginShell = "/sbin/nologin"
+
+// disabledHomeMarker is added to the name of a disabled user's home directory
+// when it's moved aside.
+const disabledHomeMarker = ".spqr-disabled-"
+
 func init() {
 	maxTmpDirNum = big.NewInt(maxTmpDirNumBase)
 }
 
-// get the user's shell and ssh keys
+// get the user's ssh keys
 func (u *User) fillInUser() error {
-	shell, err := getShell(u.Username)
-	if err != nil {
-		return err
-	}
-	u.Shell = shell
-
 	authorizedKeyFile := u.authorizedKeyPath()
 
 	authorizedKeys, err := getAuthorizedKeys(authorizedKeyFile)
@@ -103,12 +104,6 @@ func (u *User) update() error {
 	}
 
 	if u.updated.shell != "" {
-		if u.Shell == "/sbin/nologin" {
-			if err := u.passwdManipulate(false); err != nil {
-				return err
-			}
-		}
-
 		if err := u.changeShell(u.updated.shell); err != nil {
 			return err
 		}
@@ -126,6 +121,12 @@ func (u *User) update() error {
 		}
 	}
 
+	if u.updated.aging != nil {
+		if err := u.updateAging(u.updated.aging); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -187,6 +188,8 @@ func (u *User) writeOutKeys(authorizedKeys []string) error {
 		return err
 	}
 	logger.Debugf("successfully wrote authorized keys for %s", u.Username)
+	u.recordKeys(u.AuthorizedKeys, authorizedKeys)
+	u.AuthorizedKeys = authorizedKeys
 	return nil
 }
 
@@ -197,11 +200,13 @@ func (u *User) deleteAuthKeys() error {
 		return err
 	}
 	logger.Debugf("deleted authorized keys for %s", u.Username)
+	u.recordKeys(u.AuthorizedKeys, nil)
+	u.AuthorizedKeys = nil
 	return nil
 }
 
 func (u *User) authorizedKeyPath() string {
-	return path.Join(u.HomeDir, ".ssh", "authorized_keys")
+	return rootPath(path.Join(u.HomeDir, ".ssh", "authorized_keys"))
 }
 
 func osNew(userName string, fullName string, homeDir string, shell string, action UserAction, groups []string, authorizedKeys []string) (*User, error) {
@@ -213,14 +218,13 @@ func osNew(userName string, fullName string, homeDir string, shell string, actio
 	}
 
 	// check for an existing user
-	xu, _ := user.Lookup(userName)
-	if xu != nil {
+	if userExists(userName) {
 		err := fmt.Errorf("user %s already exists", userName)
 		return nil, err
 	}
 
 	n := new(user.User)
-	newUser := &User{n, nil, shell, action, groups, "", true, true, nil}
+	newUser := &User{User: n, Shell: shell, Action: action, Groups: groups, changed: true, notExist: true, createHome: true, disableSteps: defaultDisableSteps()}
 	newUser.Username = userName
 	newUser.Name = fullName
 	newUser.HomeDir = homeDir
@@ -270,50 +274,241 @@ func (u *User) getUidGid() (int, int, error) {
 }
 
 func userExists(userName string) bool {
-	u, _ := user.Lookup(userName)
-	if u != nil {
+	a, _ := currentBackend().LookupUser(userName)
+	if a != nil {
 		return true
 	}
 	return false
 }
 
-// chsh might not be appropriate for dwarwin at least
-func (u *User) setNoLogin() error {
-	if err := u.passwdManipulate(true); err != nil {
+// expireAccount sets the account's expiry date to the past, so it can't be
+// used even if it's unlocked some other way.
+func (u *User) expireAccount() error {
+	cur, err := getAging(u.Username)
+	if err != nil {
 		return err
 	}
-	return u.changeShell("/sbin/nologin")
+	// day 0 is special to some tools, so use day 1
+	expired := 1
+	want := &Aging{Expires: &expired}
+	if cur != nil && cur.Expires != nil && *cur.Expires != NoExpiry && *cur.Expires <= expired {
+		return nil
+	}
+	logger.Debugf("expiring account for %s", u.Username)
+	return u.updateAging(want.diff(cur))
 }
 
-func (u *User) changeShell(shell string) error {
-	chshPath, err := exec.LookPath("chsh")
-	if err != nil {
+// moveHomeAside renames a disabled user's home directory out of the way,
+// unless it's already been moved.
+func (u *User) moveHomeAside() error {
+	if u.HomeDir == "" || strings.Contains(path.Base(u.HomeDir), disabledHomeMarker) {
+		return nil
+	}
+	if _, err := os.Stat(rootPath(u.HomeDir)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
+	newHome := strings.Join([]string{u.HomeDir, time.Now().UTC().Format("20060102150405")}, disabledHomeMarker)
+	logger.Infof("Moving home directory for disabled user %s from %s to %s", u.Username, u.HomeDir, newHome)
+	if err := os.Rename(rootPath(u.HomeDir), rootPath(newHome)); err != nil {
+		return err
+	}
+	if err := u.setHomeDir(newHome); err != nil {
+		return err
+	}
+	u.HomeDir = newHome
+	return nil
+}
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-
+func (u *User) changeShell(shell string) error {
 	// make sure RHEL/CentOS or some other sort of unix doesn't use
 	// something else besides /sbin/nologin for setting an account to
 	// be unable to login.
-	chsh := exec.Command(chshPath, "-s", shell, u.Username)
-	chsh.Stdout = &stdout
-	chsh.Stderr = &stderr
-	err = chsh.Run()
+	logger.Debugf("Changing shell for %s to '%s'", u.Username, shell)
+	if err := currentBackend().ModifyUser(u.Username, &AccountChanges{Shell: shell}); err != nil {
+		return err
+	}
+	u.record(&audit.Entry{Change: audit.Shell, From: u.Shell, To: shell})
+	u.Shell = shell
+	return nil
+}
+
+func (u *User) osCreateUser() error {
+	a := &Account{Username: u.Username, Uid: u.Uid, Name: u.Name, HomeDir: u.HomeDir, Shell: u.Shell, PrimaryGroup: u.PrimaryGroup, Groups: u.Groups}
+	if err := currentBackend().CreateUser(a, u.createHome); err != nil {
+		return err
+	}
+
+	nu, err := Get(u.Username)
+
+	if err != nil {
+		return err
+	}
+	nu.source = u.source
+	nu.audit = u.audit
+	nu.record(&audit.Entry{Change: audit.Create, Uid: nu.Uid, Added: append([]string{nu.PrimaryGroup}, nu.Groups...)})
+
+	authKeys := u.AuthorizedKeys
+	aging := u.aging
+	u = nu
+
+	// save the keys
+	err = u.writeOutKeys(authKeys)
 	if err != nil {
-		return fmt.Errorf("Error received trying to user %s to %s: %s %s", u.Username, shell, err.Error(), stderr.String())
+		return err
+	}
+
+	if aging != nil {
+		if err = u.updateAging(aging); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+func osMakeNewGroup(groupName string) error {
+	return currentBackend().CreateGroup(groupName)
+}
+
+// getAging reads the user's account expiry date and password aging settings.
+func getAging(username string) (*Aging, error) {
+	return currentBackend().GetAging(username)
+}
+
+// passwordChanged returns when the user's password was last changed, which
+// for accounts that have never had a password is when they were created. It's
+// the zero time if the date isn't known.
+func passwordChanged(username string) (time.Time, error) {
+	return currentBackend().PasswordChanged(username)
+}
+
+// passwordLocked checks if the user's password has been locked.
+func passwordLocked(username string) (bool, error) {
+	return currentBackend().PasswordLocked(username)
+}
+
+// updateAging sets the account expiry date and password aging settings.
+func (u *User) updateAging(a *Aging) error {
+	logger.Debugf("Updating account aging for %s: %s", u.Username, a)
+	return currentBackend().SetAging(u.Username, a)
+}
+
+// osDeleteUser removes the user. The home directory and mail spool are
+// removed too if removeHome is set; they should only be removed once they've
+// been archived.
+func (u *User) osDeleteUser(removeHome bool) error {
+	return currentBackend().DeleteUser(u.Username, removeHome)
+}
+
+func (u *User) setHomeDir(homeDir string) error {
+	logger.Debugf("Setting home directory for %s to '%s'", u.Username, homeDir)
+	return currentBackend().ModifyUser(u.Username, &AccountChanges{HomeDir: homeDir})
+}
+
+func (u *User) updateName() error {
+	logger.Debugf("Updating full name for %s to '%s'", u.Username, u.updated.name)
+	if err := currentBackend().ModifyUser(u.Username, &AccountChanges{Name: u.updated.name}); err != nil {
+		return err
+	}
+	u.record(&audit.Entry{Change: audit.Name, From: u.Name, To: u.updated.name})
+	u.Name = u.updated.name
+	return nil
+}
+
+func (u *User) updateGroups() error {
+	c := new(AccountChanges)
+
+	if u.updated.groups != nil {
+		for _, g := range u.updated.groups {
+			if err := checkOrCreateGroup(g); err != nil {
+				return err
+			}
+		}
+		logger.Debugf("Updating groups for %s to '%s'", u.Username, strings.Join(u.updated.groups, ","))
+		c.Groups = u.updated.groups
+	}
+
+	if u.updated.primaryGroup != "" {
+		if err := checkOrCreateGroup(u.updated.primaryGroup); err != nil {
+			return err
+		}
+		logger.Debugf("Updating primary group for %s to '%s'", u.Username, u.updated.primaryGroup)
+		c.PrimaryGroup = u.updated.primaryGroup
+	}
+
+	if err := currentBackend().ModifyUser(u.Username, c); err != nil {
+		return err
+	}
+
+	if c.Groups != nil {
+		added, removed := util.SliceDiff(u.Groups, c.Groups)
+		if len(added) > 0 || len(removed) > 0 {
+			u.record(&audit.Entry{Change: audit.Groups, Added: added, Removed: removed})
+		}
+		u.Groups = c.Groups
+	}
+	if c.PrimaryGroup != "" {
+		u.record(&audit.Entry{Change: audit.PrimaryGroup, From: u.PrimaryGroup, To: c.PrimaryGroup})
+		u.PrimaryGroup = c.PrimaryGroup
+	}
+	return nil
+}
+
+// recordKeys records the ssh keys that were added and removed in the audit
+// log, by their fingerprints.
+func (u *User) recordKeys(oldKeys []string, newKeys []string) {
+	added, removed := util.SliceDiff(oldKeys, newKeys)
+	for _, k := range added {
+		u.record(&audit.Entry{Change: audit.KeyAdded, Fingerprint: audit.KeyFingerprint(k)})
+	}
+	for _, k := range removed {
+		u.record(&audit.Entry{Change: audit.KeyRemoved, Fingerprint: audit.KeyFingerprint(k)})
+	}
+}
+
+func (u *User) passwdManipulate(lock bool) error {
+	return currentBackend().LockUser(u.Username, lock)
+}
+
+func (u *User) clearExtraGroups(keep []string) error {
+	// inside docker at least 'groupmems' required a password to add/remove
+	// users from a group. Weeeeeird.
+	remaining := make([]string, 0, len(keep))
+	for _, g := range u.Groups {
+		for _, k := range keep {
+			if g == k {
+				remaining = append(remaining, g)
+				break
+			}
+		}
+	}
+	// Bail early if the user is already not in any extra groups besides
+	// the ones being kept
+	if len(u.Groups) == len(remaining) {
+		return nil
+	}
+	uUp := new(userUpdated)
+	uUp.groups = remaining
+	u.updated = uUp
+	if len(remaining) > 0 {
+		logger.Debugf("Removing %s from all extra groups except %s", u.Username, strings.Join(remaining, ","))
+	} else {
+		logger.Debugf("Removing %s from all extra groups", u.Username)
+	}
+	return u.updateGroups()
+}
+
 func (u *User) updateInfo(uEntry *UserInfo) error {
 	// Set the action, eh
 	u.Action = uEntry.Action
 
-	// bug out if the user's disabled or will be shortly
-	if u.Action == Disable {
+	u.disabledSigns = u.findDisabledSigns(uEntry)
+
+	// bug out if the user's disabled or deleted, or will be shortly
+	if u.Action == Disable || u.Action == Delete {
 		return nil
 	}
 
@@ -355,6 +550,24 @@ func (u *User) updateInfo(uEntry *UserInfo) error {
 		u.changed = true
 	}
 
+	wantAging, err := uEntry.aging()
+	if err != nil {
+		return err
+	}
+	if wantAging != nil {
+		curAging, err := getAging(u.Username)
+		if err != nil {
+			return err
+		}
+		if d := wantAging.diff(curAging); d != nil {
+			logger.Debugf("account aging for %s didn't match: o '%s' n '%s'", u.Username, curAging, d)
+			uUp.aging = d
+			u.changed = true
+		}
+	}
+
+	u.aging = wantAging
+
 	if u.changed == true {
 		logger.Debugf("user %s has information to update", u.Username)
 		u.updated = uUp
@@ -363,12 +576,93 @@ func (u *User) updateInfo(uEntry *UserInfo) error {
 	return nil
 }
 
-func (u *User) getPrimaryGroup() (string, error) {
-	gr, err := user.LookupGroupId(u.Gid)
+// findDisabledSigns looks for signs that the user was disabled at some point,
+// whether by spqr or something else, so they can be properly re-enabled.
+func (u *User) findDisabledSigns(uEntry *UserInfo) []string {
+	var signs []string
+
+	if u.Shell == NoLoginShell && uEntry.Shell != NoLoginShell {
+		signs = append(signs, "login shell is "+NoLoginShell)
+	}
+	if strings.Contains(path.Base(u.HomeDir), disabledHomeMarker) {
+		signs = append(signs, "home directory was moved aside to "+u.HomeDir)
+	}
+	if locked, err := passwordLocked(u.Username); err != nil {
+		logger.Debugf("could not check if %s's password is locked: %s", u.Username, err.Error())
+	} else if locked {
+		signs = append(signs, "password is locked")
+	}
+	// An expiry date from the user definition is what's wanted, not a
+	// sign of anything.
+	if uEntry.ExpiresAt == "" {
+		if sign := u.expiredSign(); sign != "" {
+			signs = append(signs, sign)
+		}
+	}
+
+	return signs
+}
+
+// expiredSign describes the user's account expiry if it has passed, or
+// returns an empty string if it hasn't.
+func (u *User) expiredSign() string {
+	cur, err := getAging(u.Username)
 	if err != nil {
-		return "", err
+		logger.Debugf("could not check if %s's account has expired: %s", u.Username, err.Error())
+		return ""
+	}
+	if cur.Expires != nil && *cur.Expires != NoExpiry && *cur.Expires <= today() {
+		return "account expired on " + expiryDate(*cur.Expires)
+	}
+	return ""
+}
+
+// clearExpiry removes the account's expiry date if it has already passed,
+// unless the user definition sets one itself.
+func (u *User) clearExpiry() error {
+	if u.aging != nil && u.aging.Expires != nil {
+		// the regular update will take care of it
+		return nil
 	}
-	return gr.Name, nil
+	cur, err := getAging(u.Username)
+	if err != nil {
+		return err
+	}
+	if cur.Expires == nil || *cur.Expires == NoExpiry || *cur.Expires > today() {
+		return nil
+	}
+	never := NoExpiry
+	logger.Debugf("clearing expiry date for %s", u.Username)
+	return u.updateAging(&Aging{Expires: &never})
+}
+
+// restoreHome moves a home directory that was moved aside when the user was
+// disabled back to where it was, if nothing else has taken its place.
+func (u *User) restoreHome() error {
+	base := path.Base(u.HomeDir)
+	i := strings.Index(base, disabledHomeMarker)
+	if i < 0 {
+		return nil
+	}
+	origHome := path.Join(path.Dir(u.HomeDir), base[:i])
+	if _, err := os.Stat(rootPath(origHome)); err == nil {
+		return fmt.Errorf("cannot move home directory for %s back from %s: %s already exists", u.Username, u.HomeDir, origHome)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	logger.Infof("Moving home directory for %s back from %s to %s", u.Username, u.HomeDir, origHome)
+	if err := os.Rename(rootPath(u.HomeDir), rootPath(origHome)); err != nil {
+		return err
+	}
+	if err := u.setHomeDir(origHome); err != nil {
+		return err
+	}
+	u.HomeDir = origHome
+	return nil
+}
+
+func today() int {
+	return int(time.Now().Unix() / secondsPerDay)
 }
 
 func getDefaultShell() string {
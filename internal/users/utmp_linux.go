@@ -0,0 +1,266 @@
+// +build linux
+
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package users
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/tideland/golib/logger"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Where logins are recorded.
+const (
+	UtmpFile    = "/var/run/utmp"
+	WtmpFile    = "/var/log/wtmp"
+	LastlogFile = "/var/log/lastlog"
+)
+
+// byteOrder is the byte order utmp, wtmp, and lastlog are written in, which is
+// whatever the machine's own byte order is.
+var byteOrder = hostByteOrder()
+
+func hostByteOrder() binary.ByteOrder {
+	switch runtime.GOARCH {
+	case "armbe", "arm64be", "m68k", "mips", "mips64", "mips64p32", "ppc", "ppc64", "s390", "s390x", "sparc", "sparc64":
+		return binary.BigEndian
+	default:
+		return binary.LittleEndian
+	}
+}
+
+// utUserProcess is the ut_type of a utmp record for a login session.
+const utUserProcess = 7
+
+// utmpRecord is struct utmp from glibc's bits/utmp.h, as laid out on linux
+// with 32 bit time values (which is how it's stored on disk even on 64 bit
+// machines).
+type utmpRecord struct {
+	Type    int16
+	_       [2]byte
+	Pid     int32
+	Line    [32]byte
+	ID      [4]byte
+	User    [32]byte
+	Host    [256]byte
+	Exit    [2]int16
+	Session int32
+	Sec     int32
+	Usec    int32
+	AddrV6  [4]int32
+	_       [20]byte
+}
+
+// lastlogRecord is struct lastlog from lastlog.h. lastlog is a sparse file
+// with one of these for each uid, at the offset of the uid times its size.
+type lastlogRecord struct {
+	Time int32
+	Line [32]byte
+	Host [256]byte
+}
+
+// utmpEntry is the useful parts of a utmp record.
+type utmpEntry struct {
+	kind int16
+	pid  int32
+	line string
+	user string
+	host string
+	time time.Time
+}
+
+// readUtmp reads every record out of a utmp or wtmp file.
+func readUtmp(utmpPath string) ([]*utmpEntry, error) {
+	f, err := os.Open(utmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*utmpEntry
+	for {
+		var r utmpRecord
+		if err = binary.Read(f, byteOrder, &r); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		entries = append(entries, &utmpEntry{
+			kind: r.Type,
+			pid:  r.Pid,
+			line: cString(r.Line[:]),
+			user: cString(r.User[:]),
+			host: cString(r.Host[:]),
+			time: time.Unix(int64(r.Sec), int64(r.Usec)*int64(time.Microsecond)),
+		})
+	}
+	return entries, nil
+}
+
+// loginHistory is what's known about everyone's logins from wtmp.
+type loginHistory struct {
+	wtmp map[string]*utmpEntry
+}
+
+// loadLoginHistory reads the last login for every user out of wtmp, along
+// with the most recently rotated wtmp if it's still there.
+func loadLoginHistory() *loginHistory {
+	h := &loginHistory{wtmp: make(map[string]*utmpEntry)}
+	for _, wtmp := range []string{WtmpFile + ".1", WtmpFile} {
+		entries, err := readUtmp(wtmp)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warningf("could not read logins from %s: %s", wtmp, err.Error())
+			}
+			continue
+		}
+		for _, e := range entries {
+			if e.kind != utUserProcess || e.user == "" {
+				continue
+			}
+			if cur, ok := h.wtmp[e.user]; !ok || e.time.After(cur.time) {
+				h.wtmp[e.user] = e
+			}
+		}
+	}
+	return h
+}
+
+// lastLogin returns when the user last logged in according to wtmp or
+// lastlog, whichever is more recent, along with where that came from. It's
+// the zero time if neither knows of a login.
+func (h *loginHistory) lastLogin(u *User) (time.Time, string) {
+	var when time.Time
+	var from string
+	if e, ok := h.wtmp[u.Username]; ok {
+		when = e.time
+		from = describeLogin("wtmp", e.line, e.host)
+	}
+	if uid, err := strconv.Atoi(u.Uid); err == nil {
+		if t, line, host, err := readLastlog(uid); err != nil {
+			if !os.IsNotExist(err) {
+				logger.Debugf("could not read %s's last login from %s: %s", u.Username, LastlogFile, err.Error())
+			}
+		} else if t.After(when) {
+			when = t
+			from = describeLogin("lastlog", line, host)
+		}
+	}
+	return when, from
+}
+
+func readLastlog(uid int) (time.Time, string, string, error) {
+	f, err := os.Open(LastlogFile)
+	if err != nil {
+		return time.Time{}, "", "", err
+	}
+	defer f.Close()
+
+	var r lastlogRecord
+	sr := io.NewSectionReader(f, int64(uid)*int64(binary.Size(r)), int64(binary.Size(r)))
+	if err = binary.Read(sr, byteOrder, &r); err != nil {
+		// the file isn't long enough to have an entry for the uid,
+		// which just means they've never logged in
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return time.Time{}, "", "", nil
+		}
+		return time.Time{}, "", "", err
+	}
+	if r.Time == 0 {
+		return time.Time{}, "", "", nil
+	}
+	return time.Unix(int64(r.Time), 0), cString(r.Line[:]), cString(r.Host[:]), nil
+}
+
+func describeLogin(source string, line string, host string) string {
+	desc := source
+	if line != "" {
+		desc = fmt.Sprintf("%s, on %s", desc, line)
+	}
+	if host != "" {
+		desc = fmt.Sprintf("%s from %s", desc, host)
+	}
+	return desc
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// userSessions returns the ttys the user is logged in on, according to utmp.
+func userSessions(username string) ([]string, error) {
+	entries, err := readUtmp(UtmpFile)
+	if err != nil {
+		return nil, err
+	}
+	var ttys []string
+	for _, e := range entries {
+		if e.kind == utUserProcess && e.user == username && e.line != "" {
+			ttys = append(ttys, e.line)
+		}
+	}
+	return ttys, nil
+}
+
+// notifySessions writes a message to every tty the user is logged in on, like
+// write(1) does.
+func (u *User) notifySessions(msg string) error {
+	ttys, err := userSessions(u.Username)
+	if err != nil {
+		return err
+	}
+	if len(ttys) == 0 {
+		logger.Debugf("%s isn't logged in, so there's nobody to notify", u.Username)
+		return nil
+	}
+	// terminals in raw mode won't go back to the start of the line on
+	// their own
+	msg = strings.Replace(msg, "\n", "\r\n", -1)
+	for _, tty := range ttys {
+		ttyPath := path.Join("/dev", tty)
+		// don't go writing to anything that isn't actually under /dev
+		if path.Dir(ttyPath) != "/dev" && path.Dir(path.Dir(ttyPath)) != "/dev" {
+			logger.Warningf("not notifying %s on odd looking tty '%s'", u.Username, tty)
+			continue
+		}
+		t, err := os.OpenFile(ttyPath, os.O_WRONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			logger.Warningf("could not open %s to notify %s: %s", ttyPath, u.Username, err.Error())
+			continue
+		}
+		if _, err = t.WriteString(msg); err != nil {
+			logger.Warningf("could not notify %s on %s: %s", u.Username, ttyPath, err.Error())
+		}
+		t.Close()
+		logger.Debugf("notified %s on %s", u.Username, ttyPath)
+	}
+	return nil
+}
@@ -57,3 +57,29 @@ func RemoveDupeSliceString(strSlice []string) []string {
 	}
 	return strSlice
 }
+
+// SliceDiff returns the strings in newSlice that aren't in oldSlice, and the
+// strings in oldSlice that aren't in newSlice.
+func SliceDiff(oldSlice []string, newSlice []string) ([]string, []string) {
+	oldSet := make(map[string]bool, len(oldSlice))
+	for _, s := range oldSlice {
+		oldSet[s] = true
+	}
+	newSet := make(map[string]bool, len(newSlice))
+	for _, s := range newSlice {
+		newSet[s] = true
+	}
+
+	var added, removed []string
+	for _, s := range newSlice {
+		if !oldSet[s] {
+			added = append(added, s)
+		}
+	}
+	for _, s := range oldSlice {
+		if !newSet[s] {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/spqr/config"
+	"github.com/ctdk/spqr/internal/fleet"
+	"github.com/ctdk/spqr/internal/groups"
+	"github.com/ctdk/spqr/internal/users"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/tideland/golib/logger"
+	"io"
+	"strings"
+	"time"
+)
+
+// runReport answers the question the report command was asked, writing the
+// answer to w.
+func runReport(c *consul.Client, q *config.ReportQuery, w io.Writer) error {
+	f, err := loadFleet(c)
+	if err != nil {
+		return err
+	}
+
+	var t fleet.Tabular
+	switch q.Kind {
+	case "user":
+		t = f.UserAccess(q.Name)
+	case "group":
+		key := q.Name
+		if !strings.Contains(key, "/") {
+			key = strings.Join([]string{config.Config.GroupKeyPrefix, key}, "/")
+		}
+		if _, ok := f.Groups[key]; !ok {
+			logger.Warningf("there's no group at %s in consul right now", key)
+		}
+		logins, unknown := f.GroupLogins(key)
+		for _, n := range unknown {
+			logger.Warningf("%s applies %s, but hasn't published an inventory, so who can log into it isn't known", n, key)
+		}
+		t = logins
+	case "drift":
+		t = f.Drift()
+	default:
+		return fmt.Errorf("unknown report '%s'", q.Kind)
+	}
+
+	return fleet.Write(w, q.Format, t)
+}
+
+// loadFleet gets the group and user definitions out of consul, along with
+// everything the nodes have published about themselves.
+func loadFleet(c *consul.Client) (*fleet.Fleet, error) {
+	f := fleet.New(groups.MergePolicy(config.Config.MergePolicy))
+	kv := c.KV()
+
+	uc := users.NewUserExtDataClient(c, config.Config.UserKeyPrefix, config.Config.DisablePolicy, config.Config.InactiveDays)
+	defs, err := uc.Definitions()
+	if err != nil {
+		return nil, err
+	}
+	f.Users = defs
+
+	nodePrefix := strings.Join([]string{config.Config.SpqrKeyPrefix, "nodes", ""}, "/")
+	kvals, _, err := kv.List(nodePrefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, kval := range kvals {
+		parts := strings.Split(strings.TrimPrefix(kval.Key, nodePrefix), "/")
+		if len(parts) != 2 {
+			continue
+		}
+		n := f.Node(parts[0])
+		var target interface{}
+		switch parts[1] {
+		case "status":
+			n.Status = new(fleet.NodeStatus)
+			target = n.Status
+		case "inventory":
+			n.Inventory = new(fleet.NodeInventory)
+			target = n.Inventory
+		default:
+			continue
+		}
+		if err = json.Unmarshal(kval.Value, target); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", kval.Key, err.Error())
+		}
+	}
+
+	// Get every group under the group key prefix, along with any group
+	// a node applied from somewhere else.
+	gp := newGroupParser(c, uc, time.Now())
+	groupPrefix := strings.Join([]string{config.Config.GroupKeyPrefix, ""}, "/")
+	kvals, _, err = kv.List(groupPrefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, kval := range kvals {
+		if kval.Key == groupPrefix {
+			continue
+		}
+		if err = addGroup(f, gp, kval); err != nil {
+			logger.Warningf("%s", err.Error())
+		}
+	}
+	for _, n := range f.Nodes {
+		if n.Status == nil {
+			continue
+		}
+		for key := range n.Status.GroupIndices {
+			if _, ok := f.Groups[key]; ok {
+				continue
+			}
+			kval, _, err := kv.Get(key, nil)
+			if err != nil {
+				return nil, err
+			}
+			if kval == nil {
+				// Drift says so.
+				continue
+			}
+			if err = addGroup(f, gp, kval); err != nil {
+				logger.Warningf("%s", err.Error())
+			}
+		}
+	}
+
+	return f, nil
+}
+
+func addGroup(f *fleet.Fleet, gp *groupParser, kval *consul.KVPair) error {
+	j := make(map[string]interface{})
+	if err := json.Unmarshal(kval.Value, &j); err != nil {
+		return fmt.Errorf("could not parse group '%s': %s", kval.Key, err.Error())
+	}
+	def, err := gp.parse(kval.Key, kval.ModifyIndex, j)
+	if err != nil {
+		return err
+	}
+	members, err := groups.ExpandIncludes(def, gp.fetch)
+	if err != nil {
+		return err
+	}
+	f.Groups[kval.Key] = &fleet.Group{Key: kval.Key, ModifyIndex: kval.ModifyIndex, Include: def.Include, Members: members}
+	return nil
+}
@@ -20,36 +20,61 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/ctdk/spqr/config"
+	"github.com/ctdk/spqr/internal/audit"
+	"github.com/ctdk/spqr/internal/command"
 	"github.com/ctdk/spqr/internal/state"
+	"github.com/ctdk/spqr/internal/users"
 	consul "github.com/hashicorp/consul/api"
 	"github.com/tideland/golib/logger"
 	"os"
+	"time"
 )
 
 func main() {
 	config.ParseConfigOptions()
 
+	if config.Config.VerifyAuditLog != "" {
+		n, err := audit.Verify(config.Config.VerifyAuditLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%s: all %d entries check out\n", config.Config.VerifyAuditLog, n)
+		os.Exit(0)
+	}
+
+	if config.Config.Report != nil {
+		consulClient, err := configureConsul()
+		if err != nil {
+			logger.Fatalf("%s", err.Error())
+		}
+		if err = runReport(consulClient, config.Config.Report, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	command.SetTimeout(time.Duration(config.Config.CommandTimeout) * time.Second)
+	users.SetRoot(config.Config.Root)
+	backend, err := users.NewBackend(config.Config.AccountBackend)
+	if err != nil {
+		logger.Fatalf("%s", err.Error())
+	}
+	users.SetBackend(backend)
+	logger.Debugf("managing accounts with the %s backend", backend.Name())
+
 	consulClient, err := configureConsul()
 	if err != nil {
-		logger.Fatalf(err.Error())
+		logger.Fatalf("%s", err.Error())
 	}
 	logger.Debugf("connected to consul")
 
-	var stateHolder *state.State
-	inCh := make(chan *state.Indices)
-	errCh := make(chan error)
-	doneCh := make(chan struct{})
-
-	if config.Config.StateFile != "" {
-		logger.Debugf("setting up the state file")
-		go state.InitState(&stateHolder, config.Config.StateFile, inCh, errCh, doneCh)
-		err = <-errCh
-		if err != nil {
-			logger.Fatalf(err.Error())
-		}
-	} else {
-		logger.Debugf("no state file configured")
+	if config.Config.Daemon {
+		runDaemon(consulClient)
+		return
 	}
 
 	// JSON incoming!
@@ -58,34 +83,58 @@ func main() {
 	dec.UseNumber()
 
 	if err := dec.Decode(&incoming); err != nil {
-		logger.Errorf(err.Error())
+		logger.Errorf("%s", err.Error())
 	}
 
 	logger.Debugf("incoming: %T %v", incoming, incoming)
 
+	var items []*incomingItem
+
 	switch incoming := incoming.(type) {
 	case nil:
 		logger.Debugf("nil event, won't do anything")
-		var h *state.Indices
-		inCh <- h
-		close(inCh)
 	case []interface{}:
 		if len(incoming) == 0 {
 			logger.Debugf("empty item, skipping")
 			break
 		}
 		logger.Debugf("key prefix or event, probably (don't care about the other possibilities)")
-		handleIncoming(consulClient, stateHolder, inCh, incoming)
+		items = parseIncoming(incoming)
 	default:
 		logger.Debugf("Not anything we're interested in: %T", incoming)
-		var h *state.Indices
-		inCh <- h
-		close(inCh)
 	}
-	<-doneCh
+
+	processItems(consulClient, items, false)
 	logger.Debugf("received done signal, exiting")
 }
 
+// processItems sets up the state file, if there is one, and hands the items
+// off to handleIncoming. It returns once the state has been updated.
+func processItems(consulClient *consul.Client, items []*incomingItem, force bool) time.Time {
+	var stateHolder *state.State
+	inCh := make(chan *state.Indices)
+	errCh := make(chan error)
+	doneCh := make(chan struct{})
+
+	if config.Config.StateFile != "" {
+		logger.Debugf("setting up the state file")
+		go state.InitState(&stateHolder, config.Config.StateFile, inCh, errCh, doneCh)
+		err := <-errCh
+		if err != nil {
+			logger.Fatalf("%s", err.Error())
+		}
+	} else {
+		logger.Debugf("no state file configured")
+	}
+
+	next := handleIncoming(consulClient, stateHolder, inCh, items, force)
+
+	if stateHolder != nil {
+		<-doneCh
+	}
+	return next
+}
+
 func configureConsul() (*consul.Client, error) {
 	conf := consul.DefaultConfig()
 
@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2018, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/ctdk/spqr/config"
+	"github.com/ctdk/spqr/internal/command"
+	"github.com/ctdk/spqr/internal/fleet"
+	"github.com/ctdk/spqr/internal/groups"
+	"github.com/ctdk/spqr/internal/state"
+	"github.com/ctdk/spqr/internal/users"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/tideland/golib/logger"
+	"os"
+	"strings"
+	"time"
+)
+
+// nodeStatus is the status of the run in progress on this node.
+type nodeStatus struct {
+	fleet.NodeStatus
+}
+
+func newNodeStatus(runID string, started time.Time) *nodeStatus {
+	return &nodeStatus{fleet.NodeStatus{
+		Version:      config.Version,
+		GitHash:      config.GitHash,
+		RunID:        runID,
+		LastRun:      started,
+		GroupIndices: make(map[string]uint64),
+		Users:        make(users.Results),
+	}}
+}
+
+// fail notes that something went wrong during the run. It's safe to call on
+// a nil *nodeStatus.
+func (ns *nodeStatus) fail(err error) {
+	if ns == nil {
+		return
+	}
+	ns.Errors = append(ns.Errors, err.Error())
+}
+
+// noteCommands adds how many commands were run during the run, and any that
+// failed, to the status. It's safe to call on a nil *nodeStatus.
+func (ns *nodeStatus) noteCommands(rp *command.Report) {
+	if ns == nil {
+		return
+	}
+	ran, total := rp.Total()
+	if ran == 0 {
+		return
+	}
+	ns.Commands = &fleet.CommandSummary{Ran: ran, Duration: total.Seconds(), Failed: rp.Failed()}
+}
+
+// publish writes the status out to consul, if publishing it is turned on.
+func (ns *nodeStatus) publish(c *consul.Client) {
+	if !config.Config.PublishStatus {
+		return
+	}
+	node, err := nodeName(c)
+	if err != nil {
+		logger.Errorf("could not work out this node's name, so not publishing its status: %s", err.Error())
+		return
+	}
+	ns.Node = node
+	ns.Duration = time.Since(ns.LastRun).Seconds()
+	ns.Succeeded = len(ns.Errors) == 0
+	for _, r := range ns.Users {
+		if r.Result == users.ResultFailed {
+			ns.Succeeded = false
+		}
+	}
+
+	key := nodeKey(node, "status")
+	if err = putJSON(c, key, ns); err != nil {
+		logger.Errorf("could not publish this node's status to %s: %s", key, err.Error())
+		return
+	}
+	logger.Debugf("published this node's status to %s", key)
+}
+
+// publishInventory writes out the inventory of the users spqr manages on this
+// node to consul, if publishing it is turned on. The users spqr manages are
+// everyone in the groups it was given this run, along with anyone it still
+// remembers in the user state.
+func publishInventory(c *consul.Client, runID string, members []*groups.Member, us *state.UserState) {
+	if !config.Config.PublishInventory {
+		return
+	}
+	node, err := nodeName(c)
+	if err != nil {
+		logger.Errorf("could not work out this node's name, so not publishing its inventory: %s", err.Error())
+		return
+	}
+
+	var usernames []string
+	seen := make(map[string]bool)
+	for _, m := range members {
+		if !seen[m.Username] {
+			seen[m.Username] = true
+			usernames = append(usernames, m.Username)
+		}
+	}
+	if us != nil {
+		for name := range us.Users {
+			if !seen[name] {
+				seen[name] = true
+				usernames = append(usernames, name)
+			}
+		}
+	}
+
+	entries, err := users.Inventory(usernames, us)
+	if err != nil {
+		logger.Errorf("could not take an inventory of this node's users: %s", err.Error())
+		return
+	}
+	inv := &fleet.NodeInventory{Node: node, RunID: runID, Updated: time.Now(), Users: entries}
+
+	key := nodeKey(node, "inventory")
+	if err = putJSON(c, key, inv); err != nil {
+		logger.Errorf("could not publish this node's inventory to %s: %s", key, err.Error())
+		return
+	}
+	logger.Debugf("published an inventory of %d users to %s", len(entries), key)
+}
+
+// nodeName is the name this node publishes things under: the one set in the
+// config if there is one, otherwise the consul agent's node name, otherwise
+// the hostname.
+func nodeName(c *consul.Client) (string, error) {
+	if config.Config.NodeName != "" {
+		return config.Config.NodeName, nil
+	}
+	name, err := c.Agent().NodeName()
+	if err == nil && name != "" {
+		return name, nil
+	}
+	if err != nil {
+		logger.Warningf("could not get the node name from the consul agent, using the hostname instead: %s", err.Error())
+	}
+	return os.Hostname()
+}
+
+// nodeKey is the key for one of the things published about a node.
+func nodeKey(node string, item string) string {
+	return strings.Join([]string{config.Config.SpqrKeyPrefix, "nodes", node, item}, "/")
+}
+
+func putJSON(c *consul.Client, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.KV().Put(&consul.KVPair{Key: key, Value: raw}, nil)
+	return err
+}